@@ -1,8 +1,9 @@
 package common
 
-import "time"
-
-//go:generate stringer -type=SkataNodeType
+import (
+	"strconv"
+	"time"
+)
 
 // TimeGenerator is an interface that exposes a method
 // to get the current Time
@@ -26,7 +27,17 @@ var IDClock TimeGenerator = DefaultClock{}
 type SkataNodeType uint
 
 func (s SkataNodeType) String() string {
-	return ""
+	switch s {
+	case HeartNode:
+		return "HeartNode"
+	case SchedulerNode:
+		return "SchedulerNode"
+	case WorkerNode:
+		return "WorkerNode"
+	case HubNode:
+		return "HubNode"
+	}
+	return "SkataNodeType(" + strconv.FormatUint(uint64(s), 10) + ")"
 }
 
 // Types of skata nodes
@@ -28,3 +28,12 @@ func TestIDMethods(T *testing.T) {
 		T.Errorf("Expected %s got %s", expected, timestamp)
 	}
 }
+
+func TestNodeTypeString(T *testing.T) {
+	if name := WorkerNode.String(); name != "WorkerNode" {
+		T.Errorf("Expected WorkerNode got %s", name)
+	}
+	if name := SkataNodeType(42).String(); name != "SkataNodeType(42)" {
+		T.Errorf("Expected SkataNodeType(42) got %s", name)
+	}
+}
@@ -1,3 +1,14 @@
 package common
 
 const version = 1
+
+// Protocol versions spoken by this build. ProtocolVersion is the
+// newest wire protocol supported and MinProtocolVersion the oldest
+// one we are still willing to downgrade to in a handshake. Version 2
+// introduced the handshake and the frame header with flags and
+// checksum; listeners still accept version 1 peers, which they
+// recognise by their framing.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 2
+)
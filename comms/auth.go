@@ -0,0 +1,95 @@
+package comms
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"skata/common"
+)
+
+// challengeNonceSize is the number of random bytes in a challenge
+const challengeNonceSize = 32
+
+// ErrNoClusterKey is returned when a listener asks for authentication
+// but the dialer has no cluster key configured
+var ErrNoClusterKey = errors.New("comms: listener requires a cluster key")
+
+// authenticationFailed is all a rejected peer gets to know, the
+// details only go to the listener's log
+var authenticationFailed = &SkataError{Code: ErrCodeAuthFailed, Message: "authentication failed"}
+
+// computeMAC signs the nonce together with the claimed node ID so
+// an answer can't be replayed for another identity
+func computeMAC(key, nonce []byte, id common.SkataNodeID) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("skata-auth-v1"))
+	mac.Write(nonce)
+	idBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(idBytes, uint64(id))
+	mac.Write(idBytes)
+	return mac.Sum(nil)
+}
+
+func (c *Connection) requiresAuthentication() bool {
+	return len(c.config.ClusterKeys) > 0
+}
+
+// rejectAuthentication drops the peer with a generic error while
+// returning the real reason to the caller
+func (c *Connection) rejectAuthentication(reason error) error {
+	c.reject(authenticationFailed)
+	return reason
+}
+
+// challengePeer is run by the listener before the connection is
+// handed out. The peer must prove it holds one of the cluster keys.
+func (c *Connection) challengePeer(ctx context.Context, id common.SkataNodeID) error {
+	challenge := new(SkataChallenge)
+	challenge.Nonce = make([]byte, challengeNonceSize)
+	if _, err := rand.Read(challenge.Nonce); err != nil {
+		return c.reject(err)
+	}
+	if err := c.Write(challenge); err != nil {
+		c.shutdown(err)
+		return err
+	}
+	msg, err := c.awaitHandshake(ctx)
+	if err != nil {
+		return err
+	}
+	answer, ok := msg.(*SkataAuthenticate)
+	if !ok {
+		return c.rejectAuthentication(fmt.Errorf("%s answered the challenge with message type %d", id.GetNodeType(), msg.Type()))
+	}
+	key, found := c.config.ClusterKeys[answer.KeyID]
+	if !found {
+		return c.rejectAuthentication(fmt.Errorf("%s used unknown cluster key %q", id.GetNodeType(), answer.KeyID))
+	}
+	if !hmac.Equal(answer.MAC, computeMAC(key, challenge.Nonce, id)) {
+		return c.rejectAuthentication(fmt.Errorf("%s sent a bad signature for cluster key %q", id.GetNodeType(), answer.KeyID))
+	}
+	return nil
+}
+
+// answerChallenge is run by the dialer when the listener asks it
+// to authenticate
+func (c *Connection) answerChallenge(challenge *SkataChallenge) error {
+	key, found := c.config.ClusterKeys[c.config.ClusterKeyID]
+	if !found {
+		c.shutdown(ErrNoClusterKey)
+		return ErrNoClusterKey
+	}
+	answer := new(SkataAuthenticate)
+	answer.source = c.Source
+	answer.KeyID = c.config.ClusterKeyID
+	answer.MAC = computeMAC(key, challenge.Nonce, c.Source)
+	if err := c.Write(answer); err != nil {
+		c.shutdown(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package comms
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"skata/common"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func authConfig(keyID string, keys map[string][]byte, logger *log.Logger) *ConnectionConfig {
+	return &ConnectionConfig{
+		ClusterKeys:  keys,
+		ClusterKeyID: keyID,
+		Logger:       logger,
+	}
+}
+
+func TestAuthenticatedHandshake(t *testing.T) {
+	logs := new(syncBuffer)
+	listener, err := NewListener("127.0.0.1:0", authConfig("", map[string][]byte{
+		"2018-01": []byte("old secret"),
+		"2018-02": []byte("new secret"),
+	}, log.New(logs, "", 0)))
+	assert.NoError(t, err)
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	// both keys are accepted while rotating
+	for _, keyID := range []string{"2018-01", "2018-02"} {
+		dialer := &Dialer{Config: authConfig(keyID, listener.config.ClusterKeys, nil)}
+		source := common.GenerateID(common.SchedulerNode)
+		client, err := dialer.DialContext(context.Background(), addr, source)
+		assert.NoError(t, err)
+		server := <-listener.ConnectionChan
+		assert.Equal(t, source, server.Source)
+		client.Close()
+		server.Close()
+	}
+
+	dialer := &Dialer{Config: authConfig("2018-02", map[string][]byte{"2018-02": []byte("wrong")}, nil)}
+	_, err = dialer.DialContext(context.Background(), addr, common.GenerateID(common.SchedulerNode))
+	if assert.IsType(t, new(SkataError), err) {
+		assert.Equal(t, ErrCodeAuthFailed, err.(*SkataError).Code)
+	}
+
+	dialer = &Dialer{Config: authConfig("2017-12", map[string][]byte{"2017-12": []byte("retired")}, nil)}
+	_, err = dialer.DialContext(context.Background(), addr, common.GenerateID(common.SchedulerNode))
+	assert.Error(t, err)
+
+	_, err = DialContext(context.Background(), addr, common.GenerateID(common.SchedulerNode))
+	assert.Equal(t, ErrNoClusterKey, err)
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), `unknown cluster key "2017-12"`)
+	}, time.Second, time.Millisecond*10)
+	assert.Contains(t, logs.String(), `bad signature for cluster key "2018-02"`)
+}
@@ -0,0 +1,123 @@
+package comms
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"skata/common"
+	"testing"
+	"time"
+)
+
+func benchmarkMessages() []SkataMessage {
+	source := common.GenerateID(common.HubNode)
+	event := &SkataEvent{Timestamp: time.Now(), EventName: "job.backup.failed"}
+	event.source = source
+	custom := &SkataCustom{Data: bytes.Repeat([]byte("x"), 512)}
+	custom.source = source
+	request := &SkataRequest{Request: Status, ID: "call-1"}
+	request.source = source
+	return []SkataMessage{event, custom, request}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	for _, msg := range benchmarkMessages() {
+		b.Run(msg.Type().String()+"/Serialize", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				msg.Serialize()
+			}
+		})
+		b.Run(msg.Type().String()+"/AppendTo", func(b *testing.B) {
+			b.ReportAllocs()
+			var data []byte
+			for i := 0; i < b.N; i++ {
+				data = msg.(Appender).AppendTo(data[:0])
+			}
+		})
+	}
+}
+
+func BenchmarkFraming(b *testing.B) {
+	for _, msg := range benchmarkMessages() {
+		b.Run(msg.Type().String()+"/Copying", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encodeFrame(createPacket(msg), 0)
+			}
+		})
+		b.Run(msg.Type().String()+"/Pooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buffer := getBuffer()
+				*buffer = appendFrame(*buffer, msg)
+				putBuffer(buffer)
+			}
+		})
+	}
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	frame := appendFrame(nil, benchmarkMessages()[1])
+	reader := bytes.NewReader(frame)
+	b.Run("Allocating", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader.Reset(frame)
+			readFrame(reader, 1<<20)
+		}
+	})
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader.Reset(frame)
+			buffer := getBuffer()
+			readFrameBuffer(reader, 1<<20, buffer)
+			putBuffer(buffer)
+		}
+	})
+}
+
+// BenchmarkFanOut has a hub send every event to a set of nodes,
+// the way job events are broadcast
+func BenchmarkFanOut(b *testing.B) {
+	for _, nodes := range []int{1, 16} {
+		b.Run(fmt.Sprintf("%dNodes", nodes), func(b *testing.B) {
+			config := *DefaultConnectionConfig
+			config.Transport = NewMemoryTransport()
+			config.Logger = log.New(ioutil.Discard, "", 0)
+			config.KeepaliveInterval = 0
+			listener, err := NewListener("hub", &config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer listener.Close()
+			dialer := &Dialer{Config: &config}
+			var hub []*Connection
+			for i := 0; i < nodes; i++ {
+				node, err := dialer.DialContext(context.Background(), "hub", common.GenerateID(common.WorkerNode))
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer node.Close()
+				go func() {
+					for range node.Pipe {
+					}
+				}()
+				conn := <-listener.ConnectionChan
+				defer conn.Close()
+				hub = append(hub, conn)
+			}
+			event := benchmarkMessages()[0]
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, conn := range hub {
+					conn.Write(event)
+				}
+			}
+		})
+	}
+}
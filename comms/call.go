@@ -0,0 +1,72 @@
+package comms
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+)
+
+// callIDPrefix marks the request IDs assigned by Call so they can't
+// collide with IDs picked by callers writing requests by hand
+const callIDPrefix = "call-"
+
+// Call sends the request and waits for the matching response. The
+// request ID is assigned by Call. A SkataError carrying the request
+// ID is returned as the error. Responses that don't belong to a
+// pending call are delivered on Pipe as usual.
+func (c *Connection) Call(ctx context.Context, request *SkataRequest) (*SkataResponse, error) {
+	request.ID = callIDPrefix + strconv.FormatUint(atomic.AddUint64(&c.callSeq, 1), 10)
+	replyChan := make(chan SkataMessage, 1)
+	c.callLock.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]chan SkataMessage)
+	}
+	c.calls[request.ID] = replyChan
+	c.callLock.Unlock()
+	defer func() {
+		c.callLock.Lock()
+		delete(c.calls, request.ID)
+		c.callLock.Unlock()
+	}()
+
+	if err := c.Write(request); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-replyChan:
+		if skataErr, ok := reply.(*SkataError); ok {
+			return nil, skataErr
+		}
+		return reply.(*SkataResponse), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+// deliverReply hands responses and errors to the pending Call
+// waiting on them and reports whether the message was consumed
+func (c *Connection) deliverReply(msg SkataMessage) bool {
+	var requestID string
+	switch reply := msg.(type) {
+	case *SkataResponse:
+		requestID = reply.RequestID
+	case *SkataError:
+		requestID = reply.RequestID
+	default:
+		return false
+	}
+	if requestID == "" {
+		return false
+	}
+	c.callLock.Lock()
+	replyChan, found := c.calls[requestID]
+	delete(c.calls, requestID)
+	c.callLock.Unlock()
+	if !found {
+		return false
+	}
+	replyChan <- msg
+	return true
+}
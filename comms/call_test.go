@@ -0,0 +1,55 @@
+package comms
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCall(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+
+	go func() {
+		request := (<-server.Pipe).(*SkataRequest)
+		server.Write(&SkataResponse{RequestID: request.ID, Data: []byte("ok")})
+		// responses nobody waits for must end up on the pipe
+		server.Write(&SkataResponse{RequestID: "unrelated"})
+		request = (<-server.Pipe).(*SkataRequest)
+		server.Write(&SkataError{Code: ErrCodeProtocol, RequestID: request.ID, Message: "no"})
+	}()
+
+	response, err := client.Call(context.Background(), &SkataRequest{Request: Status})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ok"), response.Data)
+	assert.Equal(t, "unrelated", (<-client.Pipe).(*SkataResponse).RequestID)
+
+	_, err = client.Call(context.Background(), &SkataRequest{Request: Status})
+	if assert.IsType(t, new(SkataError), err) {
+		assert.Equal(t, "no", err.(*SkataError).Message)
+	}
+}
+
+func TestCallCancellation(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+	go func() {
+		for range server.Pipe {
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	_, err := client.Call(ctx, &SkataRequest{Request: Status})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		client.Close()
+	}()
+	_, err = client.Call(context.Background(), &SkataRequest{Request: Status})
+	assert.Equal(t, ErrConnectionClosed, err)
+	assert.Empty(t, client.calls)
+}
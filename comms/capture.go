@@ -0,0 +1,259 @@
+package comms
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A capture file starts with captureMagic and the format version,
+// followed by one record per frame:
+//
+//	[direction uint8][time int64][length uint64][frame]
+//
+// where time is in unix nanoseconds and frame is the whole frame,
+// header included, exactly as it was on the wire.
+const (
+	captureMagic   = "SKATACAP"
+	captureVersion = 1
+)
+
+const captureRecordHeaderSize = 17
+
+// ErrBadCapture is returned when a capture file can't be read
+var ErrBadCapture = errors.New("comms: malformed capture file")
+
+// Direction tells whether a captured frame was received or sent
+type Direction uint8
+
+// Frame directions
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "Inbound"
+	case Outbound:
+		return "Outbound"
+	}
+	return fmt.Sprintf("Direction(%d)", uint8(d))
+}
+
+// CaptureRecord is a single captured frame
+type CaptureRecord struct {
+	Direction Direction
+	Time      time.Time
+	Frame     []byte
+}
+
+// Message decodes the message carried by the frame
+func (r *CaptureRecord) Message() (SkataMessage, error) {
+	packet, err := readFrame(bytes.NewReader(r.Frame), DefaultConnectionConfig.MaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	return parsePacket(packet)
+}
+
+// CaptureWriter writes capture records. It is safe for concurrent
+// use. Records don't say which connection they came from, so give
+// every connection its own writer unless that doesn't matter.
+type CaptureWriter struct {
+	lock   sync.Mutex
+	w      io.Writer
+	header [captureRecordHeaderSize]byte
+	err    error
+}
+
+// NewCaptureWriter starts a capture on w
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	if _, err := w.Write(append([]byte(captureMagic), captureVersion)); err != nil {
+		return nil, err
+	}
+	capture := new(CaptureWriter)
+	capture.w = w
+	return capture, nil
+}
+
+// WriteRecord appends a record to the capture. Once a write failed
+// the writer keeps returning that error.
+func (c *CaptureWriter) WriteRecord(record *CaptureRecord) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.header[0] = byte(record.Direction)
+	binary.BigEndian.PutUint64(c.header[1:], uint64(record.Time.UnixNano()))
+	binary.BigEndian.PutUint64(c.header[9:], uint64(len(record.Frame)))
+	if _, c.err = c.w.Write(c.header[:]); c.err == nil {
+		_, c.err = c.w.Write(record.Frame)
+	}
+	return c.err
+}
+
+// CaptureReader reads the records of a capture
+type CaptureReader struct {
+	r io.Reader
+}
+
+// NewCaptureReader checks the capture header and returns a reader
+// positioned at the first record
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	header := make([]byte, len(captureMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrBadCapture
+	}
+	if string(header[:len(captureMagic)]) != captureMagic || header[len(captureMagic)] != captureVersion {
+		return nil, ErrBadCapture
+	}
+	return &CaptureReader{r: r}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the capture
+func (c *CaptureReader) Next() (*CaptureRecord, error) {
+	var header [captureRecordHeaderSize]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, ErrBadCapture
+	}
+	length := binary.BigEndian.Uint64(header[9:])
+	if length < frameHeaderSize {
+		return nil, ErrBadCapture
+	}
+	// grow the frame as the data arrives rather than trusting the
+	// length of a possibly truncated file
+	var frame bytes.Buffer
+	if _, err := io.CopyN(&frame, c.r, int64(length)); err != nil {
+		return nil, ErrBadCapture
+	}
+	record := new(CaptureRecord)
+	record.Direction = Direction(header[0])
+	record.Time = time.Unix(0, int64(binary.BigEndian.Uint64(header[1:])))
+	record.Frame = frame.Bytes()
+	if binary.BigEndian.Uint64(record.Frame) != length-frameHeaderSize {
+		return nil, ErrBadCapture
+	}
+	return record, nil
+}
+
+// Capture records every frame the connection sends or receives
+// from now on to w. A nil w stops the capture, as does the first
+// failure to write to it.
+func (c *Connection) Capture(w *CaptureWriter) {
+	c.capture.Store(w)
+}
+
+func (c *Connection) captureFrame(direction Direction, frame []byte) {
+	w := c.capture.Load()
+	if w == nil {
+		return
+	}
+	record := CaptureRecord{Direction: direction, Time: time.Now(), Frame: frame}
+	if err := w.WriteRecord(&record); err != nil && c.capture.CompareAndSwap(w, nil) {
+		c.config.logf("comms: capture stopped: %v", err)
+	}
+}
+
+// ReplayOptions control how a capture is replayed
+type ReplayOptions struct {
+	// Speed scales the pauses between the recorded frames, 1
+	// keeps the original pace and 2 replays twice as fast. Zero
+	// replays the frames as fast as possible.
+	Speed float64
+	// Direction selects the frames that are replayed. Inbound
+	// frames are the messages the captured connection received.
+	Direction Direction
+}
+
+// DefaultReplayOptions replay the received messages at the pace
+// they were captured
+var DefaultReplayOptions = &ReplayOptions{
+	Speed:     1,
+	Direction: Inbound,
+}
+
+// replayable reports whether a message would have been handed out
+// on Pipe. Handshakes, keepalives, drains and stream frames are
+// handled by the connection itself and mean nothing out of it.
+func replayable(msg SkataMessage) bool {
+	switch typedMsg := msg.(type) {
+	case *SkataHandshake, *SkataChallenge, *SkataAuthenticate, *SkataStreamFrame:
+		return false
+	case *SkataSignal:
+		return typedMsg.Signal == Hello
+	}
+	return true
+}
+
+// Replay reads the capture and passes every message of the selected
+// direction to deliver, spaced out as options ask. A nil options
+// means DefaultReplayOptions. Frames that can't be decoded and
+// messages handled by the connection itself are skipped. Replay
+// stops at the first error of deliver and returns nil at the end
+// of the capture.
+func Replay(ctx context.Context, r *CaptureReader, options *ReplayOptions, deliver func(SkataMessage) error) error {
+	if options == nil {
+		options = DefaultReplayOptions
+	}
+	start := time.Now()
+	var first time.Time
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.Direction != options.Direction {
+			continue
+		}
+		if first.IsZero() {
+			first = record.Time
+		}
+		if options.Speed > 0 {
+			due := start.Add(time.Duration(float64(record.Time.Sub(first)) / options.Speed))
+			timer := time.NewTimer(time.Until(due))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		} else if err = ctx.Err(); err != nil {
+			return err
+		}
+		msg, err := record.Message()
+		if err != nil || !replayable(msg) {
+			continue
+		}
+		if err = deliver(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// ReplayToHandler replays a capture into handler, one message at a
+// time and through its middleware, the way Serve dispatches them.
+// The first error returned by a handler ends the replay.
+func ReplayToHandler(ctx context.Context, r *CaptureReader, handler *MessageHandler, options *ReplayOptions) error {
+	return Replay(ctx, r, options, Chain(handler.Middleware...)(handler.handleMessage))
+}
+
+// ReplayToConnection writes the messages of a capture onto conn,
+// for instance to play the traffic a node received back at a test
+// instance of its peer
+func ReplayToConnection(ctx context.Context, r *CaptureReader, conn *Connection, options *ReplayOptions) error {
+	return Replay(ctx, r, options, conn.Write)
+}
@@ -0,0 +1,187 @@
+package comms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// buildCapture writes a capture of the given messages, each one
+// received delay after the previous one
+func buildCapture(t *testing.T, delay time.Duration, direction Direction, messages ...SkataMessage) []byte {
+	var data bytes.Buffer
+	w, err := NewCaptureWriter(&data)
+	assert.NoError(t, err)
+	at := time.Unix(1520000000, 0)
+	for _, msg := range messages {
+		assert.NoError(t, w.WriteRecord(&CaptureRecord{Direction: direction, Time: at, Frame: appendFrame(nil, msg)}))
+		at = at.Add(delay)
+	}
+	return data.Bytes()
+}
+
+func readCapture(t *testing.T, data []byte) (records []*CaptureRecord) {
+	r, err := NewCaptureReader(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		records = append(records, record)
+	}
+}
+
+func TestCaptureFile(t *testing.T) {
+	data := buildCapture(t, time.Second, Outbound, seedMessages()...)
+	records := readCapture(t, data)
+	assert.Len(t, records, len(seedMessages()))
+	for i, msg := range seedMessages() {
+		assert.Equal(t, Outbound, records[i].Direction)
+		assert.True(t, time.Unix(1520000000+int64(i), 0).Equal(records[i].Time))
+		decoded, err := records[i].Message()
+		assert.NoError(t, err)
+		assert.Equal(t, msg, decoded)
+	}
+
+	_, err := NewCaptureReader(bytes.NewReader([]byte("SKATACAP\x02")))
+	assert.Equal(t, ErrBadCapture, err)
+	r, err := NewCaptureReader(bytes.NewReader(data[:len(data)-1]))
+	assert.NoError(t, err)
+	for err == nil {
+		_, err = r.Next()
+	}
+	assert.Equal(t, ErrBadCapture, err)
+}
+
+func TestConnectionCapture(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+	capture := new(syncBuffer)
+	w, err := NewCaptureWriter(capture)
+	assert.NoError(t, err)
+	client.Capture(w)
+
+	large := &SkataCustom{Data: bytes.Repeat([]byte("skata "), 1024)}
+	assert.NoError(t, client.Write(&SkataEvent{EventName: "job.started"}))
+	<-server.Pipe
+	assert.NoError(t, client.Write(large))
+	<-server.Pipe
+	assert.NoError(t, server.Write(&SkataRequest{Request: Status, ID: "call-1"}))
+	<-client.Pipe
+	client.Capture(nil)
+	assert.NoError(t, client.Write(&SkataEvent{EventName: "job.finished"}))
+	<-server.Pipe
+
+	records := readCapture(t, []byte(capture.String()))
+	if !assert.Len(t, records, 3) {
+		return
+	}
+	var messages []SkataMessage
+	for _, record := range records {
+		msg, err := record.Message()
+		assert.NoError(t, err)
+		messages = append(messages, msg)
+	}
+	assert.Equal(t, []Direction{Outbound, Outbound, Inbound}, []Direction{records[0].Direction, records[1].Direction, records[2].Direction})
+	assert.Equal(t, &SkataEvent{EventName: "job.started"}, messages[0])
+	assert.Equal(t, large, messages[1])
+	assert.Equal(t, "call-1", messages[2].(*SkataRequest).ID)
+	// frames are kept as they were on the wire
+	assert.Equal(t, flagCompressed, records[1].Frame[8]&flagCompressed)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestCaptureStopsOnError(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+	w := &CaptureWriter{w: failingWriter{}}
+	server.Capture(w)
+	assert.NoError(t, client.Write(&SkataEvent{EventName: "job.started"}))
+	<-server.Pipe
+	assert.Nil(t, server.capture.Load())
+	assert.EqualError(t, w.WriteRecord(&CaptureRecord{Frame: make([]byte, frameHeaderSize)}), "disk full")
+}
+
+func TestReplayToHandler(t *testing.T) {
+	data := buildCapture(t, time.Hour, Inbound,
+		&SkataEvent{EventName: "job.started"},
+		&SkataSignal{Signal: Ping},
+		&SkataStreamFrame{StreamID: 1, Op: StreamData, Data: []byte("chunk")},
+		&SkataEvent{EventName: "job.failed"},
+		&SkataRequest{Request: Status, ID: "call-1"},
+	)
+	var handled []string
+	handler := &MessageHandler{
+		FallbackHandler: func(msg SkataMessage) error {
+			handled = append(handled, msg.Type().String())
+			return nil
+		},
+	}
+	handler.HandleEvent("job.*", func(event *SkataEvent) error {
+		handled = append(handled, event.EventName)
+		return nil
+	})
+	r, _ := NewCaptureReader(bytes.NewReader(data))
+	assert.NoError(t, ReplayToHandler(context.Background(), r, handler, &ReplayOptions{}))
+	assert.Equal(t, []string{"job.started", "job.failed", "Request"}, handled)
+
+	// the first handler error ends the replay
+	failure := errors.New("boom")
+	handler.FallbackHandler = func(SkataMessage) error { return failure }
+	r, _ = NewCaptureReader(bytes.NewReader(data))
+	assert.Equal(t, failure, ReplayToHandler(context.Background(), r, handler, &ReplayOptions{}))
+}
+
+func TestReplaySpeed(t *testing.T) {
+	data := buildCapture(t, time.Millisecond*100, Inbound,
+		&SkataEvent{EventName: "a"}, &SkataEvent{EventName: "b"}, &SkataEvent{EventName: "c"})
+	count := func(SkataMessage) error { return nil }
+
+	for _, speed := range []float64{1, 2} {
+		r, _ := NewCaptureReader(bytes.NewReader(data))
+		start := time.Now()
+		assert.NoError(t, Replay(context.Background(), r, &ReplayOptions{Speed: speed}, count))
+		assert.True(t, time.Since(start) >= time.Duration(float64(time.Millisecond*200)/speed))
+	}
+
+	r, _ := NewCaptureReader(bytes.NewReader(data))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, Replay(ctx, r, nil, count))
+
+	// only the selected direction is replayed
+	r, _ = NewCaptureReader(bytes.NewReader(data))
+	start := time.Now()
+	assert.NoError(t, Replay(context.Background(), r, &ReplayOptions{Speed: 1, Direction: Outbound}, func(SkataMessage) error {
+		t.Error("inbound message replayed")
+		return nil
+	}))
+	assert.True(t, time.Since(start) < time.Millisecond*100)
+}
+
+func TestReplayToConnection(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+	data := buildCapture(t, time.Millisecond, Inbound,
+		&SkataSignal{Signal: Goodbye}, &SkataEvent{EventName: "a"}, &SkataCustom{Data: []byte("b")})
+	r, _ := NewCaptureReader(bytes.NewReader(data))
+	assert.NoError(t, ReplayToConnection(context.Background(), r, client, nil))
+	assert.Equal(t, "a", (<-server.Pipe).(*SkataEvent).EventName)
+	assert.Equal(t, []byte("b"), (<-server.Pipe).(*SkataCustom).Data)
+}
@@ -0,0 +1,112 @@
+package comms
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"skata/common"
+	"time"
+)
+
+// ConnectionConfig holds the tunables shared by a Listener
+// and the connections it accepts, or by a dialed Connection
+type ConnectionConfig struct {
+	// Transport carries the frames. If nil TCPTransport is used.
+	Transport Transport
+	// MaxFrameSize is the largest frame body, in bytes, that is
+	// accepted from the peer. Larger frames are rejected and the
+	// connection is closed. Zero uses the default.
+	MaxFrameSize uint64
+	// StreamWindow is the number of bytes the peer may send on a
+	// stream before it has to wait for the data to be read. Zero
+	// uses the default.
+	StreamWindow uint32
+	// CompressionThreshold is the packet size, in bytes, from which
+	// frames are compressed if the peer supports it. Zero disables
+	// compression.
+	CompressionThreshold int
+	// JSONCodec offers to exchange messages as JSON, which is
+	// easier to read in captures and logs but larger and slower.
+	// It is only used if both peers enable it, so it is meant for
+	// development clusters.
+	JSONCodec bool
+	// InboundQueueSize is the number of received messages buffered
+	// on Pipe. Zero leaves Pipe unbuffered.
+	InboundQueueSize int
+	// InboundPolicy decides what happens to a received message
+	// when Pipe is full
+	InboundPolicy QueuePolicy
+	// OutboundQueueSize is the number of messages Write queues
+	// per priority before OutboundPolicy applies. Zero makes Write
+	// wait for the writer.
+	OutboundQueueSize int
+	// OutboundPolicy decides what Write does when the outbound
+	// queue is full. Stream, handshake, Drain and Goodbye frames
+	// are never dropped, they wait unless the policy disconnects.
+	OutboundPolicy QueuePolicy
+	// TLSConfig enables TLS when set. Listeners that want mutual
+	// TLS should set ClientAuth to tls.RequireAndVerifyClientCert.
+	TLSConfig *tls.Config
+	// AuthorizePeer decides whether the verified certificate
+	// presented by a TLS peer may claim the given node ID. If nil
+	// AuthorizeNodeType is used. Peers whose certificate wasn't
+	// verified are refused before it is called.
+	AuthorizePeer func(cert *x509.Certificate, id common.SkataNodeID) error
+	// ClusterKeys are the pre-shared keys by key ID. A listener with
+	// keys challenges every peer to prove it holds one of them, which
+	// allows rotating keys by accepting the old and new IDs at once.
+	ClusterKeys map[string][]byte
+	// ClusterKeyID picks the key a dialer answers challenges with
+	ClusterKeyID string
+	// KeepaliveInterval is how often a Ping is sent to peers that
+	// support keepalives. Zero disables pings.
+	KeepaliveInterval time.Duration
+	// MaxMissedPongs is the number of pings in a row that may go
+	// unanswered before the connection is closed. Any frame from
+	// the peer counts as an answer. Zero only measures the round
+	// trip time.
+	MaxMissedPongs int
+	// Logger receives connection rejections. If nil the standard
+	// logger is used.
+	Logger *log.Logger
+}
+
+func (c *ConnectionConfig) logf(format string, args ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (c *ConnectionConfig) maxFrameSize() uint64 {
+	if c.MaxFrameSize == 0 {
+		return DefaultConnectionConfig.MaxFrameSize
+	}
+	return c.MaxFrameSize
+}
+
+func (c *ConnectionConfig) streamWindow() uint32 {
+	if c.StreamWindow == 0 {
+		return DefaultConnectionConfig.StreamWindow
+	}
+	return c.StreamWindow
+}
+
+// DefaultConnectionConfig is the default connection setting
+var DefaultConnectionConfig = &ConnectionConfig{
+	MaxFrameSize:         16 << 20,
+	StreamWindow:         256 << 10,
+	CompressionThreshold: 1 << 10,
+	InboundQueueSize:     64,
+	OutboundQueueSize:    64,
+	KeepaliveInterval:    time.Second * 30,
+	MaxMissedPongs:       3,
+}
+
+func (c *ConnectionConfig) transport() Transport {
+	if c.Transport == nil {
+		return TCPTransport{}
+	}
+	return c.Transport
+}
@@ -0,0 +1,200 @@
+package comms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"os"
+	"path/filepath"
+	"skata/common"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The golden vectors in testdata/wire are the reference encoding
+// described in docs/wire-format-v2.md. Run the tests with -update
+// to rewrite them after an intentional change of the wire format.
+var updateGolden = flag.Bool("update", false, "rewrite the golden wire vectors")
+
+const goldenDir = "testdata/wire/v2"
+
+// goldenSource is a worker node ID generated at unix time 1520000000
+const goldenSource common.SkataNodeID = 0x0000015A995C0002
+
+var goldenBase = SkataMessageBase{source: goldenSource}
+
+// goldenKey is the cluster key the Authenticate vector is signed with
+var goldenKey = []byte("skata-golden-cluster-key")
+
+var goldenNonce = []byte("0123456789abcdef0123456789abcdef")
+
+type wireVector struct {
+	name       string
+	message    SkataMessage
+	compressed bool
+	json       bool
+}
+
+func goldenEvent() *SkataEvent {
+	event := &SkataEvent{SkataMessageBase: goldenBase, Timestamp: time.Unix(1520000000, 123456789).UTC(), EventName: "job.backup.failed"}
+	event.SetAttribute("attempt", IntValue(-3))
+	event.SetAttribute("checksum", BytesValue([]byte{0xde, 0xad, 0xbe, 0xef}))
+	event.SetAttribute("host", StringValue("db-1"))
+	event.SetAttribute("load", FloatValue(0.75))
+	event.SetAttribute("retry", BoolValue(true))
+	event.SetAttribute("since", TimeValue(time.Unix(1519990000, 0).UTC()))
+	event.ContentType = "text/plain"
+	event.Body = []byte("disk full")
+	return event
+}
+
+func wireVectors() []wireVector {
+	return []wireVector{
+		{name: "signal-hello", message: &SkataSignal{SkataMessageBase: goldenBase, Signal: Hello}},
+		{name: "signal-ping", message: &SkataSignal{SkataMessageBase: goldenBase, Signal: Ping}},
+		{name: "signal-pong", message: &SkataSignal{SkataMessageBase: goldenBase, Signal: Pong}},
+		{name: "signal-drain", message: &SkataSignal{SkataMessageBase: goldenBase, Signal: Drain}},
+		{name: "signal-goodbye", message: &SkataSignal{SkataMessageBase: goldenBase, Signal: Goodbye}},
+		{name: "event", message: &SkataEvent{SkataMessageBase: goldenBase, Timestamp: time.Unix(1520000000, 123456789).UTC(), EventName: "job.started"}},
+		{name: "event-payload", message: goldenEvent()},
+		{name: "request-status", message: &SkataRequest{SkataMessageBase: goldenBase, Request: Status, ID: "call-1"}},
+		{name: "response", message: &SkataResponse{SkataMessageBase: goldenBase, RequestID: "call-1", Data: []byte("ok")}},
+		{name: "custom", message: &SkataCustom{SkataMessageBase: goldenBase, Data: []byte("custom payload")}},
+		{name: "handshake", message: &SkataHandshake{SkataMessageBase: goldenBase, Version: 2, MinVersion: 2, Features: FeatureStreams | FeatureCompression | FeatureKeepalive | FeatureDrain}},
+		{name: "error", message: &SkataError{SkataMessageBase: goldenBase, Code: ErrCodeHandlerFailed, RequestID: "call-1", Message: "handler failed"}},
+		{name: "stream-open", message: &SkataStreamFrame{SkataMessageBase: goldenBase, StreamID: 1, Op: StreamOpen, Increment: 256 << 10}},
+		{name: "stream-data", message: &SkataStreamFrame{SkataMessageBase: goldenBase, StreamID: 1, Op: StreamData, Data: []byte("chunk")}},
+		{name: "stream-window", message: &SkataStreamFrame{SkataMessageBase: goldenBase, StreamID: 1, Op: StreamWindow, Increment: 5}},
+		{name: "stream-close", message: &SkataStreamFrame{SkataMessageBase: goldenBase, StreamID: 1, Op: StreamClose}},
+		{name: "stream-reset", message: &SkataStreamFrame{SkataMessageBase: goldenBase, StreamID: 2, Op: StreamReset}},
+		{name: "challenge", message: &SkataChallenge{SkataMessageBase: goldenBase, Nonce: goldenNonce}},
+		{name: "authenticate", message: &SkataAuthenticate{SkataMessageBase: goldenBase, KeyID: "k1", MAC: computeMAC(goldenKey, goldenNonce, goldenSource)}},
+		{name: "custom-compressed", message: &SkataCustom{SkataMessageBase: goldenBase, Data: bytes.Repeat([]byte("skata "), 256)}, compressed: true},
+		{name: "signal-ping-json", message: &SkataSignal{SkataMessageBase: goldenBase, Signal: Ping}, json: true},
+		{name: "event-payload-json", message: goldenEvent(), json: true},
+		{name: "error-json", message: &SkataError{SkataMessageBase: goldenBase, Code: ErrCodeHandlerFailed, RequestID: "call-1", Message: "handler failed"}, json: true},
+		{name: "stream-data-json", message: &SkataStreamFrame{SkataMessageBase: goldenBase, StreamID: 1, Op: StreamData, Data: []byte("chunk")}, json: true},
+	}
+}
+
+func (v wireVector) encode(t *testing.T) []byte {
+	if v.json {
+		frame, err := appendJSONFrame(nil, v.message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+	if !v.compressed {
+		return appendFrame(nil, v.message)
+	}
+	packet, ok := compressPacket(createPacket(v.message))
+	if !ok {
+		t.Fatalf("%s doesn't compress", v.name)
+	}
+	return encodeFrame(packet, flagCompressed)
+}
+
+// invalidVector is a frame every implementation must refuse
+type invalidVector struct {
+	name  string
+	frame func() []byte
+	err   error
+}
+
+func invalidVectors() []invalidVector {
+	valid := func(msg SkataMessage) []byte {
+		return appendFrame(nil, msg)
+	}
+	withPacket := func(packet []byte) []byte {
+		return encodeFrame(packet, 0)
+	}
+	return []invalidVector{
+		{name: "bad-checksum", err: ErrChecksumMismatch, frame: func() []byte {
+			frame := valid(&SkataSignal{SkataMessageBase: goldenBase, Signal: Ping})
+			frame[len(frame)-1] ^= 0xff
+			return frame
+		}},
+		{name: "unknown-flags", err: ErrUnknownFlags, frame: func() []byte {
+			frame := valid(&SkataSignal{SkataMessageBase: goldenBase, Signal: Ping})
+			sealFrame(frame, 0x80)
+			return frame
+		}},
+		{name: "unknown-type", err: ErrUnknownMessageType, frame: func() []byte {
+			return withPacket([]byte{0x7f, 0, 0, 0, 0, 0, 0, 0, 0})
+		}},
+		{name: "empty-packet", err: ErrEmptyPacket, frame: func() []byte {
+			return withPacket(nil)
+		}},
+		{name: "truncated-handshake", err: ErrShortBuffer, frame: func() []byte {
+			packet := createPacket(&SkataHandshake{SkataMessageBase: goldenBase, Version: 2, MinVersion: 2})
+			return withPacket(packet[:len(packet)-1])
+		}},
+		{name: "trailing-bytes", err: ErrBadLength, frame: func() []byte {
+			return withPacket(append(createPacket(&SkataSignal{SkataMessageBase: goldenBase, Signal: Ping}), 0))
+		}},
+		{name: "bad-length", err: ErrBadLength, frame: func() []byte {
+			packet := createPacket(&SkataCustom{SkataMessageBase: goldenBase, Data: []byte("custom")})
+			binary.BigEndian.PutUint64(packet[9:], 1<<20)
+			return withPacket(packet)
+		}},
+	}
+}
+
+// golden returns the vector stored under name, writing data
+// there first when running with -update
+func golden(t *testing.T, name string, data []byte) []byte {
+	path := filepath.Join(goldenDir, name+".bin")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestWireConformance(t *testing.T) {
+	for _, vector := range wireVectors() {
+		t.Run(vector.name, func(t *testing.T) {
+			frame := golden(t, vector.name, vector.encode(t))
+			packet, err := readFrame(bytes.NewReader(frame), DefaultConnectionConfig.MaxFrameSize)
+			if !assert.NoError(t, err) {
+				return
+			}
+			msg, err := parsePacket(packet)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, vector.message, msg)
+			assert.Equal(t, vector.compressed, frame[8]&flagCompressed != 0)
+			if vector.compressed {
+				// DEFLATE output isn't canonical, only the packet inside is
+				assert.Equal(t, packet, createPacket(msg))
+			} else {
+				assert.Equal(t, frame, vector.encode(t))
+			}
+		})
+	}
+}
+
+func TestWireConformanceInvalid(t *testing.T) {
+	for _, vector := range invalidVectors() {
+		t.Run(vector.name, func(t *testing.T) {
+			frame := golden(t, filepath.Join("invalid", vector.name), vector.frame())
+			packet, err := readFrame(bytes.NewReader(frame), DefaultConnectionConfig.MaxFrameSize)
+			if err == nil {
+				_, err = parsePacket(packet)
+			}
+			assert.Equal(t, vector.err, err)
+		})
+	}
+}
@@ -1,107 +1,288 @@
 package comms
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"io"
 	"net"
 	"skata/common"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrConnectionClosed is reported once a connection has been closed locally
+var ErrConnectionClosed = errors.New("comms: connection closed")
+
 // MaxReadBytes is the max bytes to read from the stream
 const MaxReadBytes = 1 << 10
 
 // Acts as a frame
 func createPacket(message SkataMessage) []byte {
-	typeByte := byte(message.Type())
-	data := message.Serialize()
-	return append([]byte{typeByte}, data...)
+	return appendPacket(nil, message)
 }
 
-func parsePacket(data []byte) SkataMessage {
-	switch SkataMessageType(data[0]) {
-	case Signal:
-		signal := new(SkataSignal)
-		signal.Deserialize(data[1:])
-		return signal
+// appendPacket appends the type byte and the serialized message
+func appendPacket(data []byte, message SkataMessage) []byte {
+	data = append(data, byte(message.Type()))
+	if appender, ok := message.(Appender); ok {
+		return appender.AppendTo(data)
 	}
-	return nil
+	return append(data, message.Serialize()...)
+}
+
+func parsePacket(data []byte) (message SkataMessage, err error) {
+	if len(data) == 0 {
+		return nil, ErrEmptyPacket
+	}
+	if data[0] == jsonPacketStart {
+		return DecodeJSON(data)
+	}
+	if message, err = NewMessage(SkataMessageType(data[0])); err != nil {
+		return nil, err
+	}
+	if err = message.Deserialize(data[1:]); err != nil {
+		return nil, err
+	}
+	return
 }
 
-// Listener listens for TCP connections and attempts to establish the node type
+// Listener listens for connections on the configured transport and attempts
+// to establish the node type. If the config carries a TLSConfig every accepted
+// connection is wrapped in TLS.
 type Listener struct {
-	*net.TCPListener
+	net.Listener
 	ConnectionChan   <-chan *Connection
 	internalConnChan chan *Connection
+	config           *ConnectionConfig
+	closeOnce        sync.Once
+	closed           chan struct{}
+	connLock         sync.Mutex
+	connections      map[*Connection]struct{}
 }
 
-// NewListener is the factory method for creating a Listener
-func NewListener(addr string) *Listener {
+// NewListener is the factory method for creating a Listener.
+// If config is nil DefaultConnectionConfig is used.
+func NewListener(addr string, config *ConnectionConfig) (*Listener, error) {
+	if config == nil {
+		config = DefaultConnectionConfig
+	}
 	listener := new(Listener)
-	listenAddr, err := net.ResolveTCPAddr("tcp", addr)
+	listener.config = config
+	baseListener, err := config.transport().Listen(addr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	baseListener, err := net.ListenTCP("tcp", listenAddr)
-	if err != nil {
-		panic(err)
+	listener.Listener = baseListener
+	if config.TLSConfig != nil {
+		listener.Listener = tls.NewListener(baseListener, config.TLSConfig)
 	}
-	listener.TCPListener = baseListener
 	listener.internalConnChan = make(chan *Connection)
 	listener.ConnectionChan = listener.internalConnChan
+	listener.closed = make(chan struct{})
+	listener.connections = make(map[*Connection]struct{})
 	go listener.ListenAndAccept()
-	return listener
+	return listener, nil
 }
 
-func (l *Listener) handleNewConnection(conn *net.TCPConn) {
+func (l *Listener) handleNewConnection(conn net.Conn) {
 	skataConn := new(Connection)
-	skataConn.CreateFromTCPConn(conn)
-	select {
-	case response := <-skataConn.Pipe:
-		hello, ok := response.(*SkataSignal)
-		if !ok {
-			conn.Close()
-			return
-		}
-		skataConn.Source = hello.source
-		l.internalConnChan <- skataConn
-	case <-time.Tick(time.Second * 5):
-		conn.Close()
+	skataConn.config = l.config
+	skataConn.server = true
+	skataConn.CreateFromConn(conn)
+	if err := skataConn.serverHandshake(context.Background()); err != nil {
+		l.config.logf("comms: rejected connection from %s: %v", conn.RemoteAddr(), err)
 		return
 	}
+	l.track(skataConn)
+	select {
+	case l.internalConnChan <- skataConn:
+	case <-l.closed:
+		skataConn.Close()
+	}
 }
 
+// ListenAndAccept accepts connections until the listener is closed
 func (l *Listener) ListenAndAccept() {
+	var delay time.Duration
 	for {
-		conn, err := l.AcceptTCP()
+		conn, err := l.Accept()
 		if err != nil {
-			fmt.Println(err)
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) || err == ErrListenerClosed {
+				return
+			}
+			// failures such as running out of file descriptors
+			// are retried with a growing delay
+			if delay == 0 {
+				delay = time.Millisecond * 5
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			l.config.logf("comms: accept failed, retrying in %v: %v", delay, err)
+			time.Sleep(delay)
 			continue
 		}
+		delay = 0
 		go l.handleNewConnection(conn)
 	}
 }
 
+// Done returns a channel that is closed once the listener has
+// been closed
+func (l *Listener) Done() <-chan struct{} {
+	return l.closed
+}
+
+// Close stops accepting connections. Connections that were
+// already accepted stay open, Shutdown closes them gracefully.
+func (l *Listener) Close() (err error) {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return
+}
+
 // Connection is a high-level abstraction of writing to
 // a TCP connection
 type Connection struct {
-	Source common.SkataNodeID
-	conn   *net.TCPConn
-	Pipe   chan SkataMessage
-	closed bool
+	Source    common.SkataNodeID
+	conn      net.Conn
+	Pipe      chan SkataMessage
+	version   uint8
+	features  atomic.Uint64 // set by the handshake while the read loop runs
+	config    *ConnectionConfig
+	writeMu   sync.Mutex
+	stats     ConnectionStats
+	closeOnce sync.Once
+	closing   chan struct{}
+	closeErr  error
+	done      chan struct{}
+	err       error
+	callLock  sync.Mutex
+	calls     map[string]chan SkataMessage
+	callSeq   uint64
+	server    bool
+	outbound  [priorityLanes]chan outboundFrame
+	capture   atomic.Pointer[CaptureWriter]
+	// legacyFraming is set for version 1 peers, see readLegacyFrame
+	legacyFraming atomic.Bool
+	// negotiated is set once the read loop took over the features
+	// of the listener's handshake, see negotiatedFeatures
+	negotiated atomic.Bool
+
+	// keepalive state, accessed atomically
+	pingSent        int64
+	rtt             int64
+	unansweredPings int32
+	// inboundStalled is set while the read loop waits for room on Pipe
+	inboundStalled atomic.Bool
+
+	// drop policy state, see pin and enqueueInbound
+	pinned        [priorityLanes]atomic.Int32
+	pinnedInbound atomic.Int32
+	evictLock     sync.Mutex
+
+	// graceful shutdown state
+	leaving         chan struct{}
+	leaveOnce       sync.Once
+	goodbyeSent     chan struct{}
+	goodbyeReceived chan struct{}
+	goodbyeOnce     sync.Once
+	draining        chan struct{}
+	drainOnce       sync.Once
+
+	streamLock      sync.Mutex
+	streams         map[uint32]*Stream
+	streamSeq       uint32
+	acceptedStreams chan *Stream
 }
 
-// NewConnection creates a Connection object and returns it
-func NewConnection(address, port string, source common.SkataNodeID) (conn *Connection) {
-	conn = new(Connection)
-	conn.Source = source
-	tcpAddr, _ := net.ResolveTCPAddr("tcp", address+":"+port)
-	tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
+// ConnectionStats are counters kept for a single connection
+type ConnectionStats struct {
+	// OversizedFrames counts frames larger than MaxFrameSize
+	OversizedFrames uint64
+	// ChecksumFailures counts frames that failed their CRC check
+	ChecksumFailures uint64
+	// MalformedFrames counts frames with unknown flags, packets
+	// that could not be inflated and packets that could not be
+	// decoded
+	MalformedFrames uint64
+	// InboundDepth is the number of messages waiting on Pipe
+	InboundDepth int
+	// OutboundDepth is the number of frames waiting to be written
+	OutboundDepth int
+	// InboundDropped counts received messages dropped by InboundPolicy
+	InboundDropped uint64
+	// OutboundDropped counts messages dropped by OutboundPolicy
+	OutboundDropped uint64
+}
+
+// Dialer opens connections to a skata listener
+type Dialer struct {
+	// Config is used for every dialed connection.
+	// If nil DefaultConnectionConfig is used.
+	Config *ConnectionConfig
+}
+
+// DialContext connects to the listener at addr, announcing itself
+// as source, and completes the handshake before returning. The
+// context bounds both the dial and the handshake. If the config
+// carries a TLSConfig the connection is made over TLS; the server
+// name defaults to the host of addr, so transports whose addresses
+// have no host, such as UnixTransport, need an explicit ServerName.
+func (d *Dialer) DialContext(ctx context.Context, addr string, source common.SkataNodeID) (*Connection, error) {
+	config := d.Config
+	if config == nil {
+		config = DefaultConnectionConfig
+	}
+	var tlsConfig *tls.Config
+	if config.TLSConfig != nil {
+		var err error
+		if tlsConfig, err = clientTLSConfig(config.TLSConfig, addr); err != nil {
+			return nil, err
+		}
+	}
+	netConn, err := config.transport().Dial(ctx, addr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	conn.CreateFromTCPConn(tcpConn)
-	return
+	if tlsConfig != nil {
+		tlsConn := tls.Client(netConn, tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		netConn = tlsConn
+	}
+	conn := new(Connection)
+	conn.Source = source
+	conn.config = config
+	conn.CreateFromConn(netConn)
+	if err = conn.clientHandshake(ctx); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialContext connects to the listener at addr using DefaultConnectionConfig
+func DialContext(ctx context.Context, addr string, source common.SkataNodeID) (*Connection, error) {
+	return new(Dialer).DialContext(ctx, addr, source)
+}
+
+// NewConnection creates a Connection object and returns it.
+// If config is nil DefaultConnectionConfig is used.
+func NewConnection(address, port string, source common.SkataNodeID, config *ConnectionConfig) (*Connection, error) {
+	dialer := &Dialer{Config: config}
+	return dialer.DialContext(context.Background(), net.JoinHostPort(address, port), source)
 }
 
 // CreateFromTCPConn takes an existing connection
@@ -111,25 +292,192 @@ func (c *Connection) CreateFromTCPConn(conn *net.TCPConn) {
 	return
 }
 
-func (c *Connection) initConnection(conn *net.TCPConn) {
+// CreateFromConn takes any existing network connection,
+// such as a *tls.Conn, and injects it into the Connection object
+func (c *Connection) CreateFromConn(conn net.Conn) {
+	c.initConnection(conn)
+}
+
+func (c *Connection) initConnection(conn net.Conn) {
+	if c.config == nil {
+		c.config = DefaultConnectionConfig
+	}
 	c.conn = conn
-	c.Pipe = make(chan SkataMessage)
+	c.Pipe = make(chan SkataMessage, c.config.InboundQueueSize)
+	for i := range c.outbound {
+		c.outbound[i] = make(chan outboundFrame, c.config.OutboundQueueSize)
+	}
+	c.leaving = make(chan struct{})
+	c.goodbyeSent = make(chan struct{})
+	c.goodbyeReceived = make(chan struct{})
+	c.draining = make(chan struct{})
+	c.closing = make(chan struct{})
+	c.done = make(chan struct{})
+	c.acceptedStreams = make(chan *Stream, streamAcceptBacklog)
 	go c.commRoutine()
+	go c.writeRoutine()
+}
+
+// Version returns the protocol version negotiated with the peer
+func (c *Connection) Version() int {
+	return int(c.version)
+}
+
+// Features returns the protocol extensions negotiated with the peer
+func (c *Connection) Features() Features {
+	return Features(c.features.Load())
+}
+
+// Stats returns a snapshot of the connection counters
+func (c *Connection) Stats() (stats ConnectionStats) {
+	stats.OversizedFrames = atomic.LoadUint64(&c.stats.OversizedFrames)
+	stats.ChecksumFailures = atomic.LoadUint64(&c.stats.ChecksumFailures)
+	stats.MalformedFrames = atomic.LoadUint64(&c.stats.MalformedFrames)
+	stats.InboundDepth = len(c.Pipe)
+	for _, lane := range c.outbound {
+		stats.OutboundDepth += len(lane)
+	}
+	stats.InboundDropped = atomic.LoadUint64(&c.stats.InboundDropped)
+	stats.OutboundDropped = atomic.LoadUint64(&c.stats.OutboundDropped)
+	return
+}
+
+// Done returns a channel that is closed once the read loop has
+// ended and Pipe has been closed
+func (c *Connection) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns nil while the connection is alive and the reason
+// the read loop ended once Done is closed. A locally closed
+// connection reports ErrConnectionClosed and a peer hanging up
+// reports io.EOF.
+func (c *Connection) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
 }
 
 // Close wrapper
-func (c *Connection) Close() {
-	c.closed = true
-	c.conn.Close()
+func (c *Connection) Close() error {
+	c.shutdown(ErrConnectionClosed)
+	return nil
+}
+
+// shutdown closes the underlying connection, recording err as the
+// reason unless the connection was already shutting down
+func (c *Connection) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.closeErr = err
+		close(c.closing)
+		c.conn.Close()
+	})
+}
+
+// encode builds the frame carrying msg in a pooled buffer, as
+// JSON if that was negotiated, compressing the packet if the peer
+// supports it and it is large enough
+func (c *Connection) encode(msg SkataMessage) (frame outboundFrame) {
+	frame.buffer = getBuffer()
+	err := ErrNotJSONObject
+	if c.Features().Has(FeatureJSON) {
+		// messages that can't be written as JSON go out in binary
+		frame.data, err = appendJSONFrame(*frame.buffer, msg)
+	}
+	if err != nil {
+		frame.data = appendFrame(*frame.buffer, msg)
+	}
+	*frame.buffer = frame.data
+	packet := frame.data[frameHeaderSize:]
+	if c.Features().Has(FeatureCompression) && len(packet) >= c.config.CompressionThreshold {
+		if compressed, ok := compressPacket(packet); ok {
+			frame.data = encodeFrame(compressed, flagCompressed)
+		}
+	}
+	return
 }
 
+// Write queues a single message for the peer. It is safe to
+// call from multiple goroutines. When the outbound queue is full
+// OutboundPolicy decides whether Write waits, drops a message or
+// closes the connection. The message is sent with the priority
+// its type calls for, see WritePriority.
 func (c *Connection) Write(msg SkataMessage) error {
-	data := createPacket(msg)
-	dataLength := len(data)
-	dataLengthBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(dataLengthBytes, uint64(dataLength))
-	// append length to beginning of
-	data = append(dataLengthBytes, data...)
+	return c.WritePriority(msg, messagePriority(msg))
+}
+
+// WritePriority queues a single message on the lane of the given
+// priority. Messages of the same priority are sent in order.
+func (c *Connection) WritePriority(msg SkataMessage, priority Priority) error {
+	if priority >= priorityLanes {
+		return ErrUnknownPriority
+	}
+	select {
+	case <-c.closing:
+		return ErrConnectionClosed
+	case <-c.leaving:
+		return ErrConnectionClosed
+	default:
+	}
+	if v, ok := msg.(validator); ok {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+	frame := c.encode(msg)
+	if undroppable(msg) {
+		c.pin(&frame, priority)
+	}
+	err := c.enqueueOutbound(frame, priority)
+	if err != nil {
+		frame.release()
+	}
+	return err
+}
+
+// lastWordsTimeout bounds the write of the error sent to a peer
+// right before closing the connection
+const lastWordsTimeout = time.Second
+
+// errWriterBusy is returned by writeNow when a frame is being written
+var errWriterBusy = errors.New("comms: writer busy")
+
+// writeNow writes msg straight to the socket, ahead of anything
+// still queued. It is used for errors sent right before closing,
+// often from the read loop, so it only does its best: it gives up
+// if the writer is busy, which it may be for good with a peer that
+// stopped reading, and waits at most lastWordsTimeout otherwise.
+func (c *Connection) writeNow(msg SkataMessage) error {
+	if !c.writeMu.TryLock() {
+		return errWriterBusy
+	}
+	defer c.writeMu.Unlock()
+	frame := c.encode(msg)
+	defer frame.release()
+	c.conn.SetWriteDeadline(time.Now().Add(lastWordsTimeout))
+	defer c.conn.SetWriteDeadline(time.Time{})
+	return c.writeFrameLocked(frame.data)
+}
+
+func (c *Connection) writeFrame(frame []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrameLocked(frame)
+}
+
+// writeFrameLocked must be called with writeMu held
+func (c *Connection) writeFrameLocked(frame []byte) error {
+	// captured before it is sent, so the peer can't have received
+	// a frame that is missing from the capture
+	c.captureFrame(Outbound, frame)
+	data := frame
+	if c.legacyFraming.Load() {
+		// version 1 peers know neither flags nor checksums
+		data = append(frame[:8:8], frame[frameHeaderSize:]...)
+	}
 	expectedWriteLength := len(data)
 	writtenBytes := 0
 	for {
@@ -144,31 +492,110 @@ func (c *Connection) Write(msg SkataMessage) error {
 	}
 }
 
+// rejectFrame counts a frame that violated the framing rules,
+// tells the peer about it and drops the connection since the
+// stream can't be trusted to be in sync anymore
+func (c *Connection) rejectFrame(err error) {
+	code := ErrCodeProtocol
+	switch err {
+	case ErrFrameTooLarge:
+		code = ErrCodeFrameTooLarge
+		atomic.AddUint64(&c.stats.OversizedFrames, 1)
+	case ErrChecksumMismatch:
+		code = ErrCodeChecksum
+		atomic.AddUint64(&c.stats.ChecksumFailures, 1)
+	default:
+		atomic.AddUint64(&c.stats.MalformedFrames, 1)
+	}
+	c.reject(&SkataError{Code: code, Message: err.Error()})
+}
+
+// sniffFraming looks at the start of the first frame a listener
+// receives. Current peers open with a Handshake whose flags byte is
+// zero, version 1 peers with a Hello packet whose type byte sits in
+// its place. The returned reader replays the bytes looked at.
+func (c *Connection) sniffFraming() (io.Reader, error) {
+	start := make([]byte, 9)
+	if _, err := io.ReadFull(c.conn, start); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint64(start) == legacyHelloLength && start[8] == byte(Signal) {
+		c.legacyFraming.Store(true)
+	}
+	return io.MultiReader(bytes.NewReader(start), c.conn), nil
+}
+
 // Send a packet of data
 func (c *Connection) commRoutine() {
+	defer func() {
+		<-c.closing
+		c.err = c.closeErr
+		c.closeStreams(c.err)
+		close(c.Pipe)
+		close(c.done)
+	}()
+	var reader io.Reader = c.conn
+	if c.server {
+		var err error
+		if reader, err = c.sniffFraming(); err != nil {
+			c.shutdown(err)
+			return
+		}
+	}
 	for {
-		dataLength := make([]byte, 8)
-		_, err := c.conn.Read(dataLength)
+		buffer := getBuffer()
+		var packet []byte
+		var err error
+		if c.legacyFraming.Load() {
+			packet, err = readLegacyFrame(reader, c.config.maxFrameSize(), buffer)
+		} else {
+			packet, err = readFrameBuffer(reader, c.config.maxFrameSize(), buffer)
+		}
 		if err != nil {
-			if c.closed {
-				return
+			switch err {
+			case ErrFrameTooLarge, ErrChecksumMismatch, ErrUnknownFlags, ErrBadCompression:
+				c.rejectFrame(err)
+			default:
+				c.shutdown(err)
 			}
-			panic(err)
-		}
-		packetLength := binary.BigEndian.Uint64(dataLength)
-		packet := make([]byte, int(packetLength))
-		var bytesRead int
-		for bytesRead != int(packetLength) {
-			n, err := c.conn.Read(packet[bytesRead:])
-			if err != nil {
-				if c.closed {
-					return
-				}
-				panic(err)
-			}
-			bytesRead += n
+			return
+		}
+		c.captureFrame(Inbound, rawFrame(*buffer))
+		// whatever the peer sends shows it is still alive
+		atomic.StoreInt32(&c.unansweredPings, 0)
+		if len(packet) > 0 && packet[0] == jsonPacketStart && !c.Features().Has(FeatureJSON) {
+			// JSON is only accepted once negotiated
+			putBuffer(buffer)
+			atomic.AddUint64(&c.stats.MalformedFrames, 1)
+			continue
+		}
+		if len(packet) > 0 && SkataMessageType(packet[0]) >= UserMessageTypeStart {
+			// registered messages may keep what they are given, the
+			// built-in ones copy it so the buffer can be reused
+			packet = append([]byte(nil), packet...)
+		}
+		msg, err := parsePacket(packet)
+		putBuffer(buffer)
+		if err != nil {
+			// undecodable frames are dropped rather than handed out as nil
+			atomic.AddUint64(&c.stats.MalformedFrames, 1)
+			continue
+		}
+		if reply, ok := msg.(*SkataHandshake); ok && !c.server {
+			c.negotiatedFeatures(reply)
+		}
+		if c.deliverReply(msg) {
+			continue
+		}
+		if c.handleKeepalive(msg) || c.handleShutdownSignal(msg) {
+			continue
+		}
+		if frame, ok := msg.(*SkataStreamFrame); ok {
+			c.handleStreamFrame(frame)
+			continue
+		}
+		if !c.enqueueInbound(msg) {
+			return
 		}
-		msg := parsePacket(packet)
-		c.Pipe <- msg
 	}
 }
@@ -1,7 +1,10 @@
 package comms
 
 import (
+	"context"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"skata/common"
 	"testing"
@@ -10,6 +13,34 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// setupPair connects a client to a listener over an in-memory
+// transport. A nil config means DefaultConnectionConfig.
+func setupPair(t *testing.T, dialConfig, listenConfig *ConnectionConfig) (client, server *Connection, cleanup func()) {
+	if dialConfig == nil {
+		dialConfig = DefaultConnectionConfig
+	}
+	if listenConfig == nil {
+		listenConfig = DefaultConnectionConfig
+	}
+	transport := NewMemoryTransport()
+	dial, listen := *dialConfig, *listenConfig
+	dial.Transport = transport
+	listen.Transport = transport
+	listen.Logger = log.New(ioutil.Discard, "", 0)
+	listener, err := NewListener("pair", &listen)
+	assert.NoError(t, err)
+	dialer := &Dialer{Config: &dial}
+	client, err = dialer.DialContext(context.Background(), "pair", common.GenerateID(common.WorkerNode))
+	assert.NoError(t, err)
+	server = <-listener.ConnectionChan
+	cleanup = func() {
+		client.Close()
+		server.Close()
+		listener.Close()
+	}
+	return
+}
+
 func TestPacketWrapping(t *testing.T) {
 	signal := new(SkataSignal)
 	signal.Signal = Hello
@@ -17,34 +48,80 @@ func TestPacketWrapping(t *testing.T) {
 
 	packet := createPacket(signal)
 
-	message := parsePacket(packet)
+	message, err := parsePacket(packet)
+	assert.NoError(t, err)
 	assert.Equal(t, message, signal)
 }
 
+func TestPacketWrappingAllTypes(t *testing.T) {
+	source := common.GenerateID(common.HubNode)
+	messages := []SkataMessage{
+		&SkataSignal{SkataMessageBase{source}, Hello},
+		&SkataEvent{SkataMessageBase: SkataMessageBase{source}, Timestamp: time.Unix(1520000000, 0).UTC(), EventName: "test"},
+		&SkataRequest{SkataMessageBase{source}, Status, "1234"},
+		&SkataResponse{SkataMessageBase{source}, "1234", []byte("test")},
+		&SkataCustom{SkataMessageBase{source}, []byte("test")},
+	}
+	for _, msg := range messages {
+		message, err := parsePacket(createPacket(msg))
+		assert.NoError(t, err)
+		assert.Equal(t, msg, message)
+	}
+}
+
+func TestParsePacketErrors(t *testing.T) {
+	_, err := parsePacket(nil)
+	assert.Equal(t, ErrEmptyPacket, err)
+
+	_, err = parsePacket([]byte{byte(MaxMessageType)})
+	assert.Equal(t, ErrUnknownMessageType, err)
+}
+
+func TestParsePacketCopiesData(t *testing.T) {
+	// decoded messages must survive the frame buffer being reused
+	messages := []SkataMessage{
+		&SkataCustom{Data: []byte("custom")},
+		&SkataResponse{RequestID: "1", Data: []byte("response")},
+		&SkataStreamFrame{Op: StreamData, Data: []byte("stream")},
+		&SkataEvent{EventName: "event", Body: []byte("body")},
+	}
+	for _, msg := range messages {
+		packet := appendFrame(nil, msg)[frameHeaderSize:]
+		decoded, err := parsePacket(packet)
+		assert.NoError(t, err)
+		for i := range packet {
+			packet[i] = 0
+		}
+		assert.Equal(t, msg.Serialize(), decoded.Serialize(), msg.Type().String())
+	}
+}
+
 type testRoundTripper struct {
-	*net.TCPConn
+	net.Conn
+	listener net.Listener
 }
 
 func (t *testRoundTripper) run() {
-	addr, _ := net.ResolveTCPAddr("tcp", ":9000")
-	listener, _ := net.ListenTCP("tcp", addr)
-	conn, err := listener.AcceptTCP()
+	conn, err := t.listener.Accept()
 	if err != nil {
 		panic(err)
 	}
-	t.TCPConn = conn
+	t.Conn = conn
 	for {
 		data := make([]byte, 1024)
 		n, err := t.Read(data)
-		if err == io.EOF {
+		if err != nil {
+			// pipes report io.ErrClosedPipe rather than io.EOF
 			return
 		}
 		t.Write(data[:n])
 	}
 }
 
-func setupRoundTripper() *testRoundTripper {
+func setupRoundTripper(transport Transport) *testRoundTripper {
 	rt := new(testRoundTripper)
+	// listen up front so the dial in the test can't race the accept loop
+	rt.listener, _ = transport.Listen("roundtripper")
 	go rt.run()
 	return rt
 }
@@ -53,9 +130,11 @@ func TestRoundTripConnection(t *testing.T) {
 	signal := new(SkataSignal)
 	signal.Signal = Hello
 	signal.source = common.GenerateID(common.HubNode)
-	rt := setupRoundTripper()
-	time.Sleep(1)
-	connection := NewConnection("localhost", "9000", common.GenerateID(common.SchedulerNode))
+	transport := NewMemoryTransport()
+	rt := setupRoundTripper(transport)
+	dialer := &Dialer{Config: &ConnectionConfig{MaxFrameSize: 1024, Transport: transport}}
+	connection, err := dialer.DialContext(context.Background(), "roundtripper", common.GenerateID(common.SchedulerNode))
+	assert.NoError(t, err)
 
 	connection.Write(signal)
 
@@ -66,3 +145,45 @@ func TestRoundTripConnection(t *testing.T) {
 	connection.Close()
 	rt.Close()
 }
+
+func TestDialContextErrors(t *testing.T) {
+	// nothing listens here once the listener is closed
+	tcpListener, _ := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	addr := tcpListener.Addr().String()
+	tcpListener.Close()
+	_, err := DialContext(context.Background(), addr, common.GenerateID(common.WorkerNode))
+	assert.Error(t, err)
+
+	// a peer that never answers the handshake
+	tcpListener, _ = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer tcpListener.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err = DialContext(ctx, tcpListener.Addr().String(), common.GenerateID(common.WorkerNode))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestConnectionDoneAndErr(t *testing.T) {
+	listener, err := NewListener("127.0.0.1:0", nil)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	client, err := DialContext(context.Background(), listener.Addr().String(), common.GenerateID(common.WorkerNode))
+	assert.NoError(t, err)
+	server := <-listener.ConnectionChan
+	assert.NoError(t, client.Err())
+
+	server.Close()
+	<-server.Done()
+	assert.Equal(t, ErrConnectionClosed, server.Err())
+
+	select {
+	case <-client.Done():
+		assert.Equal(t, io.EOF, client.Err())
+	case <-time.After(time.Second):
+		t.Fatal("client read loop did not end")
+	}
+	_, open := <-client.Pipe
+	assert.False(t, open)
+	assert.Equal(t, ErrConnectionClosed, client.Write(new(SkataSignal)))
+}
@@ -0,0 +1,219 @@
+package comms
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInvalidEvent is returned when writing an event whose name
+// holds a NUL byte or which carries an attribute without a kind
+var ErrInvalidEvent = errors.New("comms: invalid event")
+
+// AttributeKind is the type of value held by an AttributeValue
+type AttributeKind uint8
+
+// Attribute kinds
+const (
+	StringAttribute AttributeKind = iota + 1
+	IntAttribute
+	FloatAttribute
+	BoolAttribute
+	BytesAttribute
+	TimeAttribute
+)
+
+// AttributeValue is a typed value attached to a SkataEvent.
+// Create one with StringValue, IntValue, FloatValue, BoolValue,
+// BytesValue or TimeValue.
+type AttributeValue struct {
+	kind AttributeKind
+	num  uint64
+	str  string
+	raw  []byte
+	time time.Time
+}
+
+// StringValue creates a string attribute
+func StringValue(v string) AttributeValue {
+	return AttributeValue{kind: StringAttribute, str: v}
+}
+
+// IntValue creates an integer attribute
+func IntValue(v int64) AttributeValue {
+	return AttributeValue{kind: IntAttribute, num: uint64(v)}
+}
+
+// FloatValue creates a floating point attribute
+func FloatValue(v float64) AttributeValue {
+	return AttributeValue{kind: FloatAttribute, num: math.Float64bits(v)}
+}
+
+// BoolValue creates a boolean attribute
+func BoolValue(v bool) AttributeValue {
+	value := AttributeValue{kind: BoolAttribute}
+	if v {
+		value.num = 1
+	}
+	return value
+}
+
+// BytesValue creates a binary attribute
+func BytesValue(v []byte) AttributeValue {
+	return AttributeValue{kind: BytesAttribute, raw: v}
+}
+
+// TimeValue creates a time attribute
+func TimeValue(v time.Time) AttributeValue {
+	return AttributeValue{kind: TimeAttribute, time: v}
+}
+
+// Kind returns the type of the value
+func (v AttributeValue) Kind() AttributeKind {
+	return v.kind
+}
+
+// SetAttribute attaches a typed value to the event
+func (s *SkataEvent) SetAttribute(key string, value AttributeValue) {
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]AttributeValue)
+	}
+	s.Attributes[key] = value
+}
+
+func (s *SkataEvent) attribute(key string, kind AttributeKind) (AttributeValue, bool) {
+	value, found := s.Attributes[key]
+	return value, found && value.kind == kind
+}
+
+// GetString returns a string attribute and whether it was set as one
+func (s *SkataEvent) GetString(key string) (string, bool) {
+	value, ok := s.attribute(key, StringAttribute)
+	return value.str, ok
+}
+
+// GetInt returns an integer attribute and whether it was set as one
+func (s *SkataEvent) GetInt(key string) (int64, bool) {
+	value, ok := s.attribute(key, IntAttribute)
+	return int64(value.num), ok
+}
+
+// GetFloat returns a floating point attribute and whether it was set as one
+func (s *SkataEvent) GetFloat(key string) (float64, bool) {
+	value, ok := s.attribute(key, FloatAttribute)
+	return math.Float64frombits(value.num), ok
+}
+
+// GetBool returns a boolean attribute and whether it was set as one
+func (s *SkataEvent) GetBool(key string) (bool, bool) {
+	value, ok := s.attribute(key, BoolAttribute)
+	return value.num != 0, ok
+}
+
+// GetBytes returns a binary attribute and whether it was set as one
+func (s *SkataEvent) GetBytes(key string) ([]byte, bool) {
+	value, ok := s.attribute(key, BytesAttribute)
+	return value.raw, ok
+}
+
+// GetTime returns a time attribute and whether it was set as one
+func (s *SkataEvent) GetTime(key string) (time.Time, bool) {
+	value, ok := s.attribute(key, TimeAttribute)
+	return value.time, ok
+}
+
+// validate rejects events that wouldn't decode on the other side:
+// the name ends at the first NUL byte, and attributes need one of
+// the defined kinds
+func (s *SkataEvent) validate() error {
+	if strings.IndexByte(s.EventName, 0) >= 0 {
+		return ErrInvalidEvent
+	}
+	for _, value := range s.Attributes {
+		if value.kind < StringAttribute || value.kind > TimeAttribute {
+			return ErrInvalidEvent
+		}
+	}
+	return nil
+}
+
+// hasPayload reports whether the event needs the payload section
+func (s *SkataEvent) hasPayload() bool {
+	return len(s.Attributes) > 0 || s.ContentType != "" || len(s.Body) > 0
+}
+
+// appendPayload encodes the attributes, in key order so the
+// encoding is deterministic, followed by the content type and body
+func (s *SkataEvent) appendPayload(data []byte) []byte {
+	keys := make([]string, 0, len(s.Attributes))
+	for key := range s.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data = binary.AppendUvarint(data, uint64(len(keys)))
+	for _, key := range keys {
+		value := s.Attributes[key]
+		data = appendLengthPrefixed(data, []byte(key))
+		data = append(data, byte(value.kind))
+		switch value.kind {
+		case StringAttribute:
+			data = appendLengthPrefixed(data, []byte(value.str))
+		case IntAttribute:
+			data = binary.AppendVarint(data, int64(value.num))
+		case FloatAttribute:
+			data = binary.BigEndian.AppendUint64(data, value.num)
+		case BoolAttribute:
+			data = append(data, byte(value.num))
+		case BytesAttribute:
+			data = appendLengthPrefixed(data, value.raw)
+		case TimeAttribute:
+			timeBytes, _ := value.time.MarshalBinary()
+			data = appendLengthPrefixed(data, timeBytes)
+		}
+	}
+	data = appendLengthPrefixed(data, []byte(s.ContentType))
+	return appendLengthPrefixed(data, s.Body)
+}
+
+func (s *SkataEvent) readPayload(r *wireReader) error {
+	count := r.uvarint()
+	if count > uint64(len(r.data)) {
+		// every attribute takes at least a couple of bytes
+		return ErrBadLength
+	}
+	if count > 0 {
+		s.Attributes = make(map[string]AttributeValue, count)
+	}
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		key := string(r.lengthPrefixed())
+		value := AttributeValue{kind: AttributeKind(r.byte())}
+		if r.err != nil {
+			break
+		}
+		switch value.kind {
+		case StringAttribute:
+			value.str = string(r.lengthPrefixed())
+		case IntAttribute:
+			value.num = uint64(r.varint())
+		case FloatAttribute:
+			value.num = r.uint64()
+		case BoolAttribute:
+			value.num = uint64(r.byte())
+		case BytesAttribute:
+			value.raw = cloneBytes(r.lengthPrefixed())
+		case TimeAttribute:
+			if err := value.time.UnmarshalBinary(r.lengthPrefixed()); err != nil && r.err == nil {
+				return ErrMalformedMessage
+			}
+		default:
+			return ErrMalformedMessage
+		}
+		s.Attributes[key] = value
+	}
+	s.ContentType = string(r.lengthPrefixed())
+	s.Body = cloneBytes(r.lengthPrefixed())
+	return r.end()
+}
@@ -0,0 +1,218 @@
+package comms
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// A frame on the wire is laid out as
+//
+//	[length uint64][flags uint8][crc32 uint32][packet]
+//
+// where length is the size of the packet and the IEEE CRC32
+// covers the length, the flags and the packet.
+const frameHeaderSize = 13
+
+// Frame flags
+const (
+	// flagCompressed marks a packet compressed with DEFLATE
+	flagCompressed byte = 1 << iota
+
+	knownFlags = flagCompressed
+)
+
+// Frame errors
+var (
+	ErrFrameTooLarge    = errors.New("comms: frame exceeds maximum size")
+	ErrChecksumMismatch = errors.New("comms: frame checksum mismatch")
+	ErrUnknownFlags     = errors.New("comms: frame has unknown flags set")
+	ErrBadCompression   = errors.New("comms: compressed packet can't be inflated")
+)
+
+func frameChecksum(header, packet []byte) uint32 {
+	checksum := crc32.ChecksumIEEE(header[:9])
+	return crc32.Update(checksum, crc32.IEEETable, packet)
+}
+
+// maxPooledBuffer keeps the buffers of unusually large frames
+// from being held on to by the pool
+const maxPooledBuffer = 64 << 10
+
+var frameBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, 0, 4<<10)
+		return &buffer
+	},
+}
+
+func getBuffer() *[]byte {
+	return frameBuffers.Get().(*[]byte)
+}
+
+func putBuffer(buffer *[]byte) {
+	if cap(*buffer) > maxPooledBuffer {
+		return
+	}
+	*buffer = (*buffer)[:0]
+	frameBuffers.Put(buffer)
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return writer
+	},
+}
+
+// compressPacket deflates the packet and reports whether that
+// actually made it smaller
+func compressPacket(packet []byte) ([]byte, bool) {
+	var compressed bytes.Buffer
+	writer := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(writer)
+	writer.Reset(&compressed)
+	writer.Write(packet)
+	writer.Close()
+	if compressed.Len() >= len(packet) {
+		return packet, false
+	}
+	return compressed.Bytes(), true
+}
+
+// decompressPacket inflates the packet, refusing to produce
+// more than maxFrameSize bytes
+func decompressPacket(packet []byte, maxFrameSize uint64) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(packet))
+	defer reader.Close()
+	decompressed, err := io.ReadAll(io.LimitReader(reader, int64(maxFrameSize)+1))
+	if err != nil {
+		// the checksum matched, so the sender produced garbage
+		return nil, ErrBadCompression
+	}
+	if uint64(len(decompressed)) > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	return decompressed, nil
+}
+
+// sealFrame fills in the header of a frame whose packet
+// follows the reserved header bytes
+func sealFrame(frame []byte, flags byte) {
+	binary.BigEndian.PutUint64(frame, uint64(len(frame)-frameHeaderSize))
+	frame[8] = flags
+	binary.BigEndian.PutUint32(frame[9:], frameChecksum(frame, frame[frameHeaderSize:]))
+}
+
+// encodeFrame prepends the frame header to a packet
+func encodeFrame(packet []byte, flags byte) []byte {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(packet))
+	frame = append(frame, packet...)
+	sealFrame(frame, flags)
+	return frame
+}
+
+// appendFrame appends a whole uncompressed frame carrying message
+// to data, serializing the message in place
+func appendFrame(data []byte, message SkataMessage) []byte {
+	start := len(data)
+	data = append(data, make([]byte, frameHeaderSize)...)
+	data = appendPacket(data, message)
+	sealFrame(data[start:], 0)
+	return data
+}
+
+// rawFrame returns the whole frame, as received, that
+// readFrameBuffer last read into buffer
+func rawFrame(buffer []byte) []byte {
+	length := binary.BigEndian.Uint64(buffer[:frameHeaderSize])
+	return buffer[:frameHeaderSize+length]
+}
+
+// Peers of protocol version 1 frame packets as
+//
+//	[length uint64][packet]
+//
+// without flags or checksum. They always open with a Hello signal,
+// which lets a listener recognise them by the Signal type byte
+// sitting where the flags of the first frame would be.
+const legacyHelloLength = 10
+
+// readLegacyFrame reads a version 1 frame into buffer. The frame is
+// laid out and sealed like a current one, so that rawFrame and
+// captures don't have to tell them apart.
+func readLegacyFrame(r io.Reader, maxFrameSize uint64, buffer *[]byte) (packet []byte, err error) {
+	frame := *buffer
+	if cap(frame) < frameHeaderSize {
+		frame = make([]byte, frameHeaderSize)
+	}
+	header := frame[:frameHeaderSize]
+	if _, err = io.ReadFull(r, header[:8]); err != nil {
+		return nil, err
+	}
+	packetLength := binary.BigEndian.Uint64(header)
+	if packetLength > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	if uint64(cap(frame)-frameHeaderSize) < packetLength {
+		frame = make([]byte, frameHeaderSize+packetLength)
+		copy(frame, header)
+	}
+	*buffer = frame
+	frame = frame[:frameHeaderSize+packetLength]
+	if _, err = io.ReadFull(r, frame[frameHeaderSize:]); err != nil {
+		return nil, err
+	}
+	sealFrame(frame, 0)
+	return frame[frameHeaderSize:], nil
+}
+
+// readFrame reads a single frame off the reader, verifies it
+// and returns the packet it carries, decompressed if needed
+func readFrame(r io.Reader, maxFrameSize uint64) ([]byte, error) {
+	var buffer []byte
+	return readFrameBuffer(r, maxFrameSize, &buffer)
+}
+
+// readFrameBuffer is readFrame reading into buffer, which is grown
+// if the frame doesn't fit. Unless the frame was compressed the
+// packet returned points into the buffer.
+func readFrameBuffer(r io.Reader, maxFrameSize uint64, buffer *[]byte) (packet []byte, err error) {
+	frame := *buffer
+	if cap(frame) < frameHeaderSize {
+		frame = make([]byte, frameHeaderSize)
+	}
+	header := frame[:frameHeaderSize]
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	packetLength := binary.BigEndian.Uint64(header)
+	if packetLength > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	flags := header[8]
+	if flags&^knownFlags != 0 {
+		return nil, ErrUnknownFlags
+	}
+	if uint64(cap(frame)-frameHeaderSize) < packetLength {
+		frame = make([]byte, frameHeaderSize+packetLength)
+		copy(frame, header)
+		header = frame[:frameHeaderSize]
+	}
+	*buffer = frame
+	packet = frame[frameHeaderSize : frameHeaderSize+packetLength]
+	if _, err = io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+	if frameChecksum(header, packet) != binary.BigEndian.Uint32(header[9:]) {
+		return nil, ErrChecksumMismatch
+	}
+	if flags&flagCompressed != 0 {
+		return decompressPacket(packet, maxFrameSize)
+	}
+	return
+}
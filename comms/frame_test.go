@@ -0,0 +1,137 @@
+package comms
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"skata/common"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	packet := []byte("test packet")
+	decoded, err := readFrame(bytes.NewReader(encodeFrame(packet, 0)), 1024)
+	assert.NoError(t, err)
+	assert.Equal(t, packet, decoded)
+}
+
+func TestFrameViolations(t *testing.T) {
+	frame := encodeFrame([]byte("test packet"), 0)
+	_, err := readFrame(bytes.NewReader(frame), 4)
+	assert.Equal(t, ErrFrameTooLarge, err)
+
+	corrupted := append([]byte(nil), frame...)
+	corrupted[len(corrupted)-1] ^= 0xFF
+	_, err = readFrame(bytes.NewReader(corrupted), 1024)
+	assert.Equal(t, ErrChecksumMismatch, err)
+
+	flagged := append([]byte(nil), frame...)
+	flagged[8] = 0x80
+	_, err = readFrame(bytes.NewReader(flagged), 1024)
+	assert.Equal(t, ErrUnknownFlags, err)
+}
+
+func TestOversizedFrameClosesConnection(t *testing.T) {
+	listener, err := NewListener("127.0.0.1:0", &ConnectionConfig{MaxFrameSize: 64})
+	assert.NoError(t, err)
+	defer listener.Close()
+	client, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	hello := new(SkataSignal)
+	hello.source = common.GenerateID(common.WorkerNode)
+	hello.Signal = Hello
+	client.Write(encodeFrame(createPacket(hello), 0))
+	server := <-listener.ConnectionChan
+
+	custom := new(SkataCustom)
+	custom.Data = make([]byte, 128)
+	client.Write(encodeFrame(createPacket(custom), 0))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := readFrame(client, 1024)
+	assert.NoError(t, err)
+	msg, err := parsePacket(packet)
+	assert.NoError(t, err)
+	if assert.IsType(t, new(SkataError), msg) {
+		assert.Equal(t, ErrCodeFrameTooLarge, msg.(*SkataError).Code)
+	}
+	assert.Equal(t, uint64(1), server.Stats().OversizedFrames)
+}
+
+func TestMalformedFrameClosesConnection(t *testing.T) {
+	listener, err := NewListener("127.0.0.1:0", nil)
+	assert.NoError(t, err)
+	defer listener.Close()
+	client, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	hello := new(SkataSignal)
+	hello.source = common.GenerateID(common.WorkerNode)
+	hello.Signal = Hello
+	client.Write(encodeFrame(createPacket(hello), 0))
+	server := <-listener.ConnectionChan
+
+	// the checksum is fine, the DEFLATE stream inside is not
+	client.Write(encodeFrame([]byte{0xff, 0xff, 0xff}, flagCompressed))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := readFrame(client, 1024)
+	assert.NoError(t, err)
+	msg, err := parsePacket(packet)
+	assert.NoError(t, err)
+	if assert.IsType(t, new(SkataError), msg) {
+		assert.Equal(t, ErrCodeProtocol, msg.(*SkataError).Code)
+	}
+	<-server.Done()
+	assert.Equal(t, uint64(1), server.Stats().MalformedFrames)
+	assert.Zero(t, server.Stats().ChecksumFailures)
+}
+
+func TestCompressedFrame(t *testing.T) {
+	packet := bytes.Repeat([]byte("compress me "), 100)
+	compressed, ok := compressPacket(packet)
+	assert.True(t, ok)
+	assert.True(t, len(compressed) < len(packet))
+
+	frame := encodeFrame(compressed, flagCompressed)
+	decoded, err := readFrame(bytes.NewReader(frame), 2048)
+	assert.NoError(t, err)
+	assert.Equal(t, packet, decoded)
+
+	// the size limit applies to the inflated packet too
+	_, err = readFrame(bytes.NewReader(frame), 256)
+	assert.Equal(t, ErrFrameTooLarge, err)
+
+	_, ok = compressPacket([]byte("tiny"))
+	assert.False(t, ok)
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+	assert.True(t, client.Features().Has(FeatureCompression))
+	assert.True(t, server.Features().Has(FeatureCompression))
+
+	custom := new(SkataCustom)
+	custom.Data = bytes.Repeat([]byte("log line\n"), 1000)
+	assert.NoError(t, client.Write(custom))
+	assert.Equal(t, custom.Data, (<-server.Pipe).(*SkataCustom).Data)
+
+	config := *DefaultConnectionConfig
+	config.CompressionThreshold = 0
+	dialer := &Dialer{Config: &config}
+	listener, err := NewListener("127.0.0.1:0", nil)
+	assert.NoError(t, err)
+	defer listener.Close()
+	raw, err := dialer.DialContext(context.Background(), listener.Addr().String(), common.GenerateID(common.WorkerNode))
+	assert.NoError(t, err)
+	defer raw.Close()
+	assert.False(t, raw.Features().Has(FeatureCompression))
+	assert.False(t, (<-listener.ConnectionChan).Features().Has(FeatureCompression))
+}
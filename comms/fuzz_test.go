@@ -0,0 +1,122 @@
+package comms
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// seedMessages are valid messages of every built-in type
+func seedMessages() []SkataMessage {
+	event := &SkataEvent{Timestamp: time.Unix(1520000000, 0).UTC(), EventName: "job.backup.failed"}
+	event.SetAttribute("host", StringValue("db-1"))
+	event.SetAttribute("attempt", IntValue(3))
+	event.ContentType = "text/plain"
+	event.Body = []byte("disk full")
+	return []SkataMessage{
+		&SkataSignal{Signal: Ping},
+		event,
+		&SkataRequest{Request: Status, ID: "call-1"},
+		&SkataResponse{RequestID: "call-1", Data: []byte("ok")},
+		&SkataCustom{Data: []byte("custom")},
+		&SkataHandshake{Version: 1, MinVersion: 1, Features: FeatureStreams},
+		&SkataError{Code: ErrCodeProtocol, RequestID: "call-1", Message: "no"},
+		&SkataStreamFrame{StreamID: 1, Op: StreamData, Data: []byte("chunk")},
+		&SkataChallenge{Nonce: bytes.Repeat([]byte{7}, challengeNonceSize)},
+		&SkataAuthenticate{KeyID: "k1", MAC: []byte("mac")},
+	}
+}
+
+// checkDecoded verifies that a message decoded from arbitrary data
+// encodes to something that decodes back to the same encoding
+func checkDecoded(t *testing.T, msg SkataMessage) {
+	encoded := msg.Serialize()
+	again, err := NewMessage(msg.Type())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = again.Deserialize(encoded); err != nil {
+		t.Fatalf("re-encoded %s doesn't decode: %v", msg.Type(), err)
+	}
+	if !bytes.Equal(encoded, again.Serialize()) {
+		t.Fatalf("%s encoding isn't stable", msg.Type())
+	}
+}
+
+func checkDecodeError(t *testing.T, err error) {
+	if err != nil && !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("unexpected error type %T: %v", err, err)
+	}
+}
+
+func fuzzMessage(f *testing.F, messageType SkataMessageType) {
+	for _, msg := range seedMessages() {
+		if msg.Type() == messageType {
+			f.Add(msg.Serialize())
+		}
+	}
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, _ := NewMessage(messageType)
+		err := msg.Deserialize(data)
+		checkDecodeError(t, err)
+		if err == nil {
+			checkDecoded(t, msg)
+		}
+	})
+}
+
+func FuzzSignal(f *testing.F)       { fuzzMessage(f, Signal) }
+func FuzzEvent(f *testing.F)        { fuzzMessage(f, Event) }
+func FuzzRequest(f *testing.F)      { fuzzMessage(f, Request) }
+func FuzzResponse(f *testing.F)     { fuzzMessage(f, Response) }
+func FuzzCustom(f *testing.F)       { fuzzMessage(f, Custom) }
+func FuzzHandshake(f *testing.F)    { fuzzMessage(f, Handshake) }
+func FuzzError(f *testing.F)        { fuzzMessage(f, Error) }
+func FuzzStreamFrame(f *testing.F)  { fuzzMessage(f, StreamFrame) }
+func FuzzChallenge(f *testing.F)    { fuzzMessage(f, Challenge) }
+func FuzzAuthenticate(f *testing.F) { fuzzMessage(f, Authenticate) }
+
+func FuzzParsePacket(f *testing.F) {
+	for _, msg := range seedMessages() {
+		f.Add(createPacket(msg))
+		data, _ := EncodeJSON(msg)
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		msg, err := parsePacket(packet)
+		if err == ErrEmptyPacket || err == ErrUnknownMessageType {
+			return
+		}
+		checkDecodeError(t, err)
+		if err == nil {
+			checkDecoded(t, msg)
+		}
+	})
+}
+
+func TestTruncatedMessages(t *testing.T) {
+	for _, msg := range seedMessages() {
+		data := msg.Serialize()
+		for length := 0; length < len(data); length++ {
+			decoded, _ := NewMessage(msg.Type())
+			err := decoded.Deserialize(data[:length])
+			if err == nil {
+				// trailing variable fields may legitimately be cut short
+				continue
+			}
+			if err != ErrShortBuffer && err != ErrBadLength {
+				t.Errorf("%s truncated to %d bytes: %v", msg.Type(), length, err)
+			}
+		}
+	}
+	_, err := parsePacket([]byte{byte(Signal), 1, 2})
+	assert.Equal(t, ErrShortBuffer, err)
+	_, err = parsePacket(append(createPacket(&SkataSignal{}), 0))
+	assert.Equal(t, ErrBadLength, err)
+	_, err = parsePacket(append([]byte{byte(Custom)}, bytes.Repeat([]byte{0xff}, 16)...))
+	assert.Equal(t, ErrBadLength, err)
+}
@@ -1,5 +1,10 @@
 package comms
 
+import (
+	"context"
+	"sync"
+)
+
 // EventHandler is a handler specific to a SkataEvent
 type EventHandler func(*SkataEvent) error
 
@@ -13,37 +18,150 @@ type RequestHandler func(*SkataRequest) error
 // This allows custom messages to be passed.
 type CustomHandler func(*SkataCustom) error
 
+// FallbackHandler handles any message no other handler took
+type FallbackHandler func(SkataMessage) error
+
+// Handler is the shape every typed handler takes once adapted
+// for middleware
+type Handler func(SkataMessage) error
+
+// ErrorPolicy decides what Serve does when a handler fails
+type ErrorPolicy uint8
+
+// Defined error policies. Handler errors are always logged.
+const (
+	// LogErrors only logs the error and keeps serving
+	LogErrors ErrorPolicy = iota
+	// ReplyWithError also sends the peer a SkataError, tied to
+	// the request if the failed message was one
+	ReplyWithError
+	// CloseOnError also closes the connection
+	CloseOnError
+)
+
 // MessageHandler is a collection of handlers for each specific message type
 type MessageHandler struct {
 	EventHandlers   map[string]EventHandler
 	SignalHandlers  map[SignalType]SignalHandler
 	RequestHandlers map[RequestType]RequestHandler
-	CustomHandlers  []CustomHandler
+	// CustomHandlers are all run, in order, for every SkataCustom
+	CustomHandlers []CustomHandler
+	// FallbackHandler receives the messages none of the handlers
+	// above are registered for. If nil those messages are dropped.
+	FallbackHandler FallbackHandler
+	// Concurrency is the number of messages handled at the same
+	// time by Serve. Zero or one handles messages one by one, in order.
+	Concurrency int
+	// ErrorPolicy applies to errors returned by any handler
+	ErrorPolicy ErrorPolicy
+	// Middleware wraps the dispatch of every message, the first
+	// middleware being the outermost
+	Middleware []Middleware
+
+	eventPatterns *eventTrie
 }
 
 func (m *MessageHandler) handleMessage(msg SkataMessage) error {
 	switch typedMsg := msg.(type) {
 	case *SkataEvent:
-		handler, found := m.EventHandlers[typedMsg.EventName]
-		if found {
-			if err := handler(typedMsg); err != nil {
-				return err
-			}
+		if handler := m.eventHandler(typedMsg.EventName); handler != nil {
+			return handler(typedMsg)
 		}
 	case *SkataSignal:
-		handler, found := m.SignalHandlers[typedMsg.Signal]
-		if found {
-			if err := handler(typedMsg); err != nil {
-				return err
-			}
+		if handler, found := m.SignalHandlers[typedMsg.Signal]; found {
+			return handler(typedMsg)
 		}
 	case *SkataRequest:
-		handler, found := m.RequestHandlers[typedMsg.Request]
-		if found {
-			if err := handler(typedMsg); err != nil {
-				return err
+		if handler, found := m.RequestHandlers[typedMsg.Request]; found {
+			return handler(typedMsg)
+		}
+	case *SkataCustom:
+		if len(m.CustomHandlers) > 0 {
+			for _, handler := range m.CustomHandlers {
+				if err := handler(typedMsg); err != nil {
+					return err
+				}
 			}
+			return nil
 		}
 	}
+	if m.FallbackHandler != nil {
+		return m.FallbackHandler(msg)
+	}
 	return nil
 }
+
+// Serve reads messages off the connection and dispatches them to
+// the handler until the context is done or the connection ends.
+// It waits for running handlers before returning the reason it
+// stopped. When the peer asks to drain, Serve lets the running
+// handlers finish and shuts the connection down, returning nil
+// once the peer said Goodbye. A peer that doesn't say Goodbye
+// within DrainTimeout is disconnected.
+func (c *Connection) Serve(ctx context.Context, handler *MessageHandler) error {
+	handle := Chain(handler.Middleware...)(handler.handleMessage)
+	slots := make(chan struct{}, handler.Concurrency)
+	var running sync.WaitGroup
+	defer running.Wait()
+	draining := c.Draining()
+	drainRequested := false
+	for {
+		if drainRequested && len(c.Pipe) == 0 {
+			// everything sent before the drain request has been handled
+			drainRequested = false
+			running.Wait()
+			go func() {
+				ctx, cancel := context.WithTimeout(ctx, DrainTimeout)
+				defer cancel()
+				c.Shutdown(ctx)
+			}()
+		}
+		select {
+		case msg, ok := <-c.Pipe:
+			if !ok {
+				if c.saidGoodbye() {
+					return nil
+				}
+				return c.Err()
+			}
+			if handler.Concurrency <= 1 {
+				c.dispatch(handler, handle, msg)
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				c.dispatch(handler, handle, msg)
+				<-slots
+			}()
+		case <-draining:
+			draining = nil
+			drainRequested = true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Connection) dispatch(handler *MessageHandler, handle Handler, msg SkataMessage) {
+	err := handle(msg)
+	if err == nil {
+		return
+	}
+	c.config.logf("comms: %s handler for %s failed: %v", msg.Type(), c.Source.GetNodeType(), err)
+	switch handler.ErrorPolicy {
+	case ReplyWithError:
+		reply := &SkataError{Code: ErrCodeHandlerFailed, Message: err.Error()}
+		if request, ok := msg.(*SkataRequest); ok {
+			reply.RequestID = request.ID
+		}
+		c.Write(reply)
+	case CloseOnError:
+		c.shutdown(err)
+	}
+}
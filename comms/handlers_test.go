@@ -0,0 +1,120 @@
+package comms
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeDispatch(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+
+	handled := make(chan string, 10)
+	handler := &MessageHandler{
+		EventHandlers: map[string]EventHandler{"test": func(*SkataEvent) error {
+			handled <- "event"
+			return nil
+		}},
+		SignalHandlers: map[SignalType]SignalHandler{Hello: func(*SkataSignal) error {
+			handled <- "signal"
+			return nil
+		}},
+		RequestHandlers: map[RequestType]RequestHandler{Status: func(*SkataRequest) error {
+			handled <- "request"
+			return nil
+		}},
+		CustomHandlers: []CustomHandler{
+			func(*SkataCustom) error {
+				handled <- "custom 1"
+				return nil
+			},
+			func(*SkataCustom) error {
+				handled <- "custom 2"
+				return nil
+			},
+		},
+		FallbackHandler: func(msg SkataMessage) error {
+			handled <- "fallback"
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- server.Serve(ctx, handler) }()
+
+	// one lane keeps the messages in order
+	for _, msg := range []SkataMessage{
+		&SkataEvent{EventName: "test"},
+		&SkataSignal{Signal: Hello},
+		&SkataRequest{Request: Status},
+		&SkataCustom{},
+		&SkataResponse{},
+	} {
+		client.WritePriority(msg, PriorityNormal)
+	}
+	for _, expected := range []string{"event", "signal", "request", "custom 1", "custom 2", "fallback"} {
+		assert.Equal(t, expected, <-handled)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-served)
+}
+
+func TestServeErrorPolicies(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+
+	failure := errors.New("status unavailable")
+	handler := &MessageHandler{
+		RequestHandlers: map[RequestType]RequestHandler{Status: func(*SkataRequest) error {
+			return failure
+		}},
+		ErrorPolicy: ReplyWithError,
+	}
+	go server.Serve(context.Background(), handler)
+	_, err := client.Call(context.Background(), &SkataRequest{Request: Status})
+	if assert.IsType(t, new(SkataError), err) {
+		assert.Equal(t, ErrCodeHandlerFailed, err.(*SkataError).Code)
+		assert.Equal(t, failure.Error(), err.(*SkataError).Message)
+	}
+
+	client, server, cleanup = setupPair(t, nil, nil)
+	defer cleanup()
+	handler.ErrorPolicy = CloseOnError
+	served := make(chan error)
+	go func() { served <- server.Serve(context.Background(), handler) }()
+	client.Write(&SkataRequest{Request: Status})
+	assert.Equal(t, failure, <-served)
+	<-client.Done()
+}
+
+func TestServeConcurrency(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	handler := &MessageHandler{
+		CustomHandlers: []CustomHandler{func(*SkataCustom) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		}},
+		Concurrency: 2,
+	}
+	go server.Serve(context.Background(), handler)
+	client.Write(&SkataCustom{})
+	client.Write(&SkataCustom{})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("handlers did not run concurrently")
+		}
+	}
+	close(release)
+}
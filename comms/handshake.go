@@ -0,0 +1,212 @@
+package comms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"skata/common"
+	"time"
+)
+
+// HandshakeTimeout is how long either side waits for the
+// peer's half of the handshake
+const HandshakeTimeout = time.Second * 5
+
+// legacyProtocolVersion is the version assumed for peers that
+// open with a bare Hello signal instead of a SkataHandshake. Such
+// peers also use the old framing, see readLegacyFrame.
+const legacyProtocolVersion = 1
+
+// supportedFeatures are the protocol extensions this build understands
+const supportedFeatures = FeatureStreams | FeatureCompression | FeatureKeepalive | FeatureDrain | FeatureJSON
+
+// localFeatures are the extensions offered on this connection
+func (c *Connection) localFeatures() Features {
+	features := supportedFeatures
+	if c.config.CompressionThreshold <= 0 {
+		features &^= FeatureCompression
+	}
+	if !c.config.JSONCodec {
+		features &^= FeatureJSON
+	}
+	return features
+}
+
+// Handshake errors
+var (
+	ErrHandshakeTimeout = errors.New("comms: handshake timed out")
+	ErrHandshakeFailed  = errors.New("comms: unexpected handshake message")
+)
+
+// negotiateVersion picks the newest protocol version that both
+// this build and the remote peer support
+func negotiateVersion(remoteVersion, remoteMinVersion uint8) (uint8, error) {
+	version := remoteVersion
+	if version > common.ProtocolVersion {
+		version = common.ProtocolVersion
+	}
+	minVersion := remoteMinVersion
+	if minVersion < common.MinProtocolVersion {
+		minVersion = common.MinProtocolVersion
+	}
+	if version < minVersion {
+		return 0, &SkataError{
+			Code: ErrCodeVersionMismatch,
+			Message: fmt.Sprintf("no common protocol version: local %d-%d, remote %d-%d",
+				common.MinProtocolVersion, common.ProtocolVersion, remoteMinVersion, remoteVersion),
+		}
+	}
+	return version, nil
+}
+
+func (c *Connection) localHandshake() *SkataHandshake {
+	handshake := new(SkataHandshake)
+	handshake.source = c.Source
+	handshake.Version = common.ProtocolVersion
+	handshake.MinVersion = common.MinProtocolVersion
+	handshake.Features = c.localFeatures()
+	return handshake
+}
+
+// reject tells the peer why it is being dropped and closes the
+// connection with err as the reason
+func (c *Connection) reject(err error) error {
+	skataErr, ok := err.(*SkataError)
+	if !ok {
+		skataErr = &SkataError{Code: ErrCodeProtocol, Message: err.Error()}
+	}
+	c.writeNow(skataErr)
+	c.shutdown(err)
+	return err
+}
+
+// awaitHandshake waits for the first message of the peer
+func (c *Connection) awaitHandshake(ctx context.Context) (SkataMessage, error) {
+	timer := time.NewTimer(HandshakeTimeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-c.Pipe:
+		if !ok {
+			return nil, c.Err()
+		}
+		if undroppable(msg) {
+			c.pinnedInbound.Add(-1)
+		}
+		return msg, nil
+	case <-ctx.Done():
+		c.shutdown(ctx.Err())
+		return nil, ctx.Err()
+	case <-timer.C:
+		c.shutdown(ErrHandshakeTimeout)
+		return nil, ErrHandshakeTimeout
+	}
+}
+
+// negotiatedFeatures is called by the read loop of a dialed
+// connection for the first Handshake it receives. Taking the
+// features over right away rather than in clientHandshake means
+// frames the listener sends using them right after its reply are
+// read with them in effect.
+func (c *Connection) negotiatedFeatures(reply *SkataHandshake) {
+	if c.negotiated.CompareAndSwap(false, true) {
+		c.features.Store(uint64(reply.Features & c.localFeatures()))
+	}
+}
+
+// clientHandshake is run by the dialing side. It announces the
+// local capabilities and waits for the listener's verdict.
+func (c *Connection) clientHandshake(ctx context.Context) error {
+	if err := c.Write(c.localHandshake()); err != nil {
+		c.shutdown(err)
+		return err
+	}
+	msg, err := c.awaitHandshake(ctx)
+	if err != nil {
+		return err
+	}
+	if challenge, ok := msg.(*SkataChallenge); ok {
+		if err = c.answerChallenge(challenge); err != nil {
+			return err
+		}
+		if msg, err = c.awaitHandshake(ctx); err != nil {
+			return err
+		}
+	}
+	switch reply := msg.(type) {
+	case *SkataHandshake:
+		if reply.Version < common.MinProtocolVersion || reply.Version > common.ProtocolVersion {
+			return c.reject(&SkataError{
+				Code:    ErrCodeVersionMismatch,
+				Message: fmt.Sprintf("listener chose unsupported protocol version %d", reply.Version),
+			})
+		}
+		// the read loop already took over the features, see
+		// negotiatedFeatures
+		c.version = reply.Version
+		c.startKeepalive()
+		return nil
+	case *SkataError:
+		c.shutdown(reply)
+		return reply
+	}
+	return c.reject(ErrHandshakeFailed)
+}
+
+// serverHandshake is run by the listener on every accepted connection.
+// Peers opening with a plain Hello signal are treated as legacy peers
+// speaking legacyProtocolVersion without any optional features.
+// Listeners holding cluster keys challenge the peer before accepting
+// it, which legacy peers can't answer.
+func (c *Connection) serverHandshake(ctx context.Context) error {
+	msg, err := c.awaitHandshake(ctx)
+	if err != nil {
+		return err
+	}
+	switch hello := msg.(type) {
+	case *SkataHandshake:
+		version, err := negotiateVersion(hello.Version, hello.MinVersion)
+		if err != nil {
+			return c.reject(err)
+		}
+		if err = c.authorizePeer(hello.source); err != nil {
+			return c.reject(err)
+		}
+		if c.requiresAuthentication() {
+			if err = c.challengePeer(ctx, hello.source); err != nil {
+				return err
+			}
+		}
+		c.Source = hello.source
+		c.version = version
+		features := hello.Features & c.localFeatures()
+		reply := new(SkataHandshake)
+		reply.Version = c.version
+		reply.MinVersion = common.MinProtocolVersion
+		reply.Features = features
+		// the reply still goes out in binary, the features apply
+		// to every frame after it
+		frame := c.encode(reply)
+		c.pin(&frame, messagePriority(reply))
+		c.features.Store(uint64(features))
+		if err = c.enqueueOutbound(frame, messagePriority(reply)); err != nil {
+			frame.release()
+			return err
+		}
+		c.startKeepalive()
+		return nil
+	case *SkataSignal:
+		if hello.Signal != Hello {
+			break
+		}
+		if err := c.authorizePeer(hello.source); err != nil {
+			return c.reject(err)
+		}
+		if c.requiresAuthentication() {
+			return c.rejectAuthentication(errors.New("legacy hello can't authenticate"))
+		}
+		c.Source = hello.source
+		c.version = legacyProtocolVersion
+		return nil
+	}
+	return c.reject(ErrHandshakeFailed)
+}
@@ -0,0 +1,87 @@
+package comms
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"skata/common"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshake(t *testing.T) {
+	listener, err := NewListener("127.0.0.1:0", nil)
+	assert.NoError(t, err)
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	source := common.GenerateID(common.WorkerNode)
+	client, err := NewConnection(host, port, source, nil)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.Equal(t, common.ProtocolVersion, client.Version())
+
+	server := <-listener.ConnectionChan
+	defer server.Close()
+	assert.Equal(t, source, server.Source)
+	assert.Equal(t, common.ProtocolVersion, server.Version())
+	assert.Equal(t, client.Features(), server.Features())
+}
+
+func TestLegacyHelloHandshake(t *testing.T) {
+	listener, err := NewListener("127.0.0.1:0", nil)
+	assert.NoError(t, err)
+	defer listener.Close()
+	tcpConn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	assert.NoError(t, err)
+	defer tcpConn.Close()
+
+	// version 1 peers frame packets without flags and checksum
+	source := common.GenerateID(common.SchedulerNode)
+	hello := []byte{0, 0, 0, 0, 0, 0, 0, legacyHelloLength, byte(Signal), 0, 0, 0, 0, 0, 0, 0, 0, byte(Hello)}
+	binary.BigEndian.PutUint64(hello[9:], uint64(source))
+	_, err = tcpConn.Write(hello)
+	assert.NoError(t, err)
+
+	server := <-listener.ConnectionChan
+	defer server.Close()
+	assert.Equal(t, source, server.Source)
+	assert.Equal(t, legacyProtocolVersion, server.Version())
+
+	// and get their messages framed the same way
+	assert.NoError(t, server.Write(&SkataCustom{Data: []byte("hi")}))
+	frame := make([]byte, 8)
+	_, err = io.ReadFull(tcpConn, frame)
+	assert.NoError(t, err)
+	packet := make([]byte, binary.BigEndian.Uint64(frame))
+	_, err = io.ReadFull(tcpConn, packet)
+	assert.NoError(t, err)
+	msg, err := parsePacket(packet)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hi"), msg.(*SkataCustom).Data)
+
+	frame = appendFrame(nil, &SkataCustom{Data: []byte("hello")})
+	_, err = tcpConn.Write(append(frame[:8:8], frame[frameHeaderSize:]...))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), (<-server.Pipe).(*SkataCustom).Data)
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	version, err := negotiateVersion(common.ProtocolVersion+1, common.MinProtocolVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(common.ProtocolVersion), version)
+
+	// version 1 is only spoken with the legacy framing, never
+	// agreed on in a handshake
+	version, err = negotiateVersion(2, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(2), version)
+	_, err = negotiateVersion(1, 1)
+	assert.IsType(t, new(SkataError), err)
+
+	_, err = negotiateVersion(common.ProtocolVersion+2, common.ProtocolVersion+1)
+	if assert.IsType(t, new(SkataError), err) {
+		assert.Equal(t, ErrCodeVersionMismatch, err.(*SkataError).Code)
+	}
+}
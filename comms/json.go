@@ -0,0 +1,295 @@
+package comms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"skata/common"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A JSON packet is a single JSON object in place of the type byte
+// and the binary body. Its first byte, '{', lies in the reserved
+// range of type bytes so it can't be mistaken for a binary packet.
+const jsonPacketStart = '{'
+
+// ErrBadJSON is returned when a JSON message can't be decoded
+var ErrBadJSON error = decodeError("comms: malformed JSON message")
+
+// ErrNotJSONObject is returned for messages that don't encode to a
+// JSON object and so can't be sent as JSON
+var ErrNotJSONObject = errors.New("comms: message does not encode to a JSON object")
+
+// sourceSetter is implemented by messages embedding SkataMessageBase
+type sourceSetter interface {
+	Source() common.SkataNodeID
+	setSource(common.SkataNodeID)
+}
+
+func (m *SkataMessageBase) setSource(source common.SkataNodeID) {
+	m.source = source
+}
+
+// EncodeJSON encodes a message as a JSON object holding its type,
+// its source and its exported fields. Messages of every built-in
+// type can be encoded, user defined ones as long as encoding/json
+// turns them into an object.
+func EncodeJSON(msg SkataMessage) ([]byte, error) {
+	return appendJSONPacket(nil, msg)
+}
+
+// DecodeJSON decodes a message encoded by EncodeJSON. The type
+// has to be registered, like for binary messages.
+func DecodeJSON(data []byte) (SkataMessage, error) {
+	var header struct {
+		Type   *SkataMessageType `json:"type"`
+		Source string            `json:"source"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil || header.Type == nil {
+		return nil, ErrBadJSON
+	}
+	msg, err := NewMessage(*header.Type)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, msg); err != nil {
+		return nil, ErrBadJSON
+	}
+	if event, ok := msg.(*SkataEvent); ok && strings.IndexByte(event.EventName, 0) >= 0 {
+		// the binary encoding ends the name at the first NUL
+		return nil, ErrBadJSON
+	}
+	if base, ok := msg.(sourceSetter); ok && header.Source != "" {
+		source, err := strconv.ParseUint(header.Source, 0, 64)
+		if err != nil {
+			return nil, ErrBadJSON
+		}
+		base.setSource(common.SkataNodeID(source))
+	}
+	return msg, nil
+}
+
+// appendJSONPacket appends the JSON encoding of msg, with the type
+// and the source ahead of the message's own fields
+func appendJSONPacket(data []byte, msg SkataMessage) ([]byte, error) {
+	fields, err := json.Marshal(msg)
+	if err != nil {
+		return data, err
+	}
+	if len(fields) < 2 || fields[0] != '{' {
+		return data, ErrNotJSONObject
+	}
+	messageType, _ := msg.Type().MarshalText()
+	data = append(data, `{"type":"`...)
+	data = append(data, messageType...)
+	data = append(data, '"')
+	if base, ok := msg.(sourceSetter); ok {
+		data = fmt.Appendf(data, `,"source":"0x%016x"`, uint64(base.Source()))
+	}
+	if len(fields) > 2 {
+		data = append(data, ',')
+	}
+	return append(data, fields[1:]...), nil
+}
+
+// appendJSONFrame is appendFrame for connections that negotiated
+// FeatureJSON
+func appendJSONFrame(data []byte, msg SkataMessage) ([]byte, error) {
+	start := len(data)
+	data = append(data, make([]byte, frameHeaderSize)...)
+	data, err := appendJSONPacket(data, msg)
+	if err != nil {
+		return data[:start], err
+	}
+	sealFrame(data[start:], 0)
+	return data, nil
+}
+
+// FormatMessage renders a message as indented JSON for tools and logs
+func FormatMessage(msg SkataMessage) (string, error) {
+	packet, err := appendJSONPacket(nil, msg)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err = json.Indent(&out, packet, "", "  "); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// FormatFrame decodes a whole frame, binary or JSON, compressed or
+// not, and renders the message it carries like FormatMessage
+func FormatFrame(frame []byte) (string, error) {
+	packet, err := readFrame(bytes.NewReader(frame), DefaultConnectionConfig.MaxFrameSize)
+	if err != nil {
+		return "", err
+	}
+	msg, err := parsePacket(packet)
+	if err != nil {
+		return "", err
+	}
+	return FormatMessage(msg)
+}
+
+// enumText names a value of one of the byte sized enums, falling
+// back to the number for values without a name
+func enumText(names []string, value uint64) []byte {
+	if value < uint64(len(names)) && names[value] != "" {
+		return []byte(names[value])
+	}
+	return strconv.AppendUint(nil, value, 10)
+}
+
+// parseEnum accepts what enumText produces
+func parseEnum(names []string, text []byte, bits int) (uint64, error) {
+	for value, name := range names {
+		if name != "" && name == string(text) {
+			return uint64(value), nil
+		}
+	}
+	value, err := strconv.ParseUint(string(text), 10, bits)
+	if err != nil {
+		return 0, ErrBadJSON
+	}
+	return value, nil
+}
+
+// MarshalText names the type in JSON messages
+func (t SkataMessageType) MarshalText() ([]byte, error) {
+	return enumText(messageTypeNames[:], uint64(t)), nil
+}
+
+// UnmarshalText accepts a type name or number
+func (t *SkataMessageType) UnmarshalText(text []byte) error {
+	value, err := parseEnum(messageTypeNames[:], text, 8)
+	*t = SkataMessageType(value)
+	return err
+}
+
+// MarshalText names the signal in JSON messages
+func (s SignalType) MarshalText() ([]byte, error) {
+	return enumText(signalNames[:], uint64(s)), nil
+}
+
+// UnmarshalText accepts a signal name or number
+func (s *SignalType) UnmarshalText(text []byte) error {
+	value, err := parseEnum(signalNames[:], text, 8)
+	*s = SignalType(value)
+	return err
+}
+
+// MarshalText names the request in JSON messages
+func (r RequestType) MarshalText() ([]byte, error) {
+	return enumText(requestNames[:], uint64(r)), nil
+}
+
+// UnmarshalText accepts a request name or number
+func (r *RequestType) UnmarshalText(text []byte) error {
+	value, err := parseEnum(requestNames[:], text, 8)
+	*r = RequestType(value)
+	return err
+}
+
+// MarshalText names the error code in JSON messages
+func (c ErrorCode) MarshalText() ([]byte, error) {
+	return enumText(errorCodeNames[:], uint64(c)), nil
+}
+
+// UnmarshalText accepts an error code name or number
+func (c *ErrorCode) UnmarshalText(text []byte) error {
+	value, err := parseEnum(errorCodeNames[:], text, 8)
+	*c = ErrorCode(value)
+	return err
+}
+
+// MarshalText names the stream operation in JSON messages
+func (o StreamOp) MarshalText() ([]byte, error) {
+	return enumText(streamOpNames[:], uint64(o)), nil
+}
+
+// UnmarshalText accepts a stream operation name or number
+func (o *StreamOp) UnmarshalText(text []byte) error {
+	value, err := parseEnum(streamOpNames[:], text, 8)
+	*o = StreamOp(value)
+	return err
+}
+
+var attributeKindNames = [...]string{
+	StringAttribute: "string",
+	IntAttribute:    "int",
+	FloatAttribute:  "float",
+	BoolAttribute:   "bool",
+	BytesAttribute:  "bytes",
+	TimeAttribute:   "time",
+}
+
+// MarshalJSON encodes the value as an object with a single key
+// naming its kind, like {"int": 3}
+func (v AttributeValue) MarshalJSON() ([]byte, error) {
+	var value interface{}
+	switch v.kind {
+	case StringAttribute:
+		value = v.str
+	case IntAttribute:
+		value = int64(v.num)
+	case FloatAttribute:
+		value = math.Float64frombits(v.num)
+	case BoolAttribute:
+		value = v.num != 0
+	case BytesAttribute:
+		value = v.raw
+	case TimeAttribute:
+		value = v.time
+	default:
+		return nil, ErrBadJSON
+	}
+	return json.Marshal(map[string]interface{}{attributeKindNames[v.kind]: value})
+}
+
+// UnmarshalJSON decodes what MarshalJSON produces
+func (v *AttributeValue) UnmarshalJSON(data []byte) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil || len(object) != 1 {
+		return ErrBadJSON
+	}
+	for kind, raw := range object {
+		var err error
+		switch kind {
+		case "string":
+			var value string
+			err = json.Unmarshal(raw, &value)
+			*v = StringValue(value)
+		case "int":
+			var value int64
+			err = json.Unmarshal(raw, &value)
+			*v = IntValue(value)
+		case "float":
+			var value float64
+			err = json.Unmarshal(raw, &value)
+			*v = FloatValue(value)
+		case "bool":
+			var value bool
+			err = json.Unmarshal(raw, &value)
+			*v = BoolValue(value)
+		case "bytes":
+			var value []byte
+			err = json.Unmarshal(raw, &value)
+			*v = BytesValue(value)
+		case "time":
+			var value time.Time
+			err = json.Unmarshal(raw, &value)
+			*v = TimeValue(value)
+		default:
+			return ErrBadJSON
+		}
+		if err != nil {
+			return ErrBadJSON
+		}
+	}
+	return nil
+}
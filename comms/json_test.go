@@ -0,0 +1,147 @@
+package comms
+
+import (
+	"net"
+	"skata/common"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	source := common.GenerateID(common.WorkerNode)
+	for _, msg := range append(seedMessages(), goldenEvent()) {
+		msg.(sourceSetter).setSource(source)
+		data, err := EncodeJSON(msg)
+		assert.NoError(t, err)
+		decoded, err := DecodeJSON(data)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, decoded)
+		assert.Equal(t, source, decoded.(sourceSetter).Source())
+
+		decoded, err = parsePacket(data)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, decoded)
+	}
+}
+
+func TestJSONReadable(t *testing.T) {
+	signal := &SkataSignal{SkataMessageBase: goldenBase, Signal: Goodbye}
+	data, err := EncodeJSON(signal)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"type":"Signal","source":"0x0000015a995c0002","signal":"Goodbye"}`, string(data))
+
+	decoded, err := DecodeJSON([]byte(`{"type":"1","signal":"4","source":"1234"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, Goodbye, decoded.(*SkataSignal).Signal)
+	assert.Equal(t, common.SkataNodeID(1234), decoded.(*SkataSignal).Source())
+}
+
+func TestJSONErrors(t *testing.T) {
+	for _, data := range []string{
+		`{`,
+		`{"signal":"Ping"}`,
+		`{"type":"Signal","signal":"Shout"}`,
+		`{"type":"Signal","source":"node"}`,
+		`{"type":"Event","eventName":"a\u0000b"}`,
+		`{"type":"Event","attributes":{"a":{"int":1,"bool":true}}}`,
+		`{"type":"Event","attributes":{"a":{"complex":1}}}`,
+		`{"type":"Event","attributes":{"a":{"int":"one"}}}`,
+	} {
+		_, err := parsePacket([]byte(data))
+		assert.Equal(t, ErrBadJSON, err, data)
+	}
+	_, err := DecodeJSON([]byte(`{"type":"127"}`))
+	assert.Equal(t, ErrUnknownMessageType, err)
+
+	// times JSON can't represent
+	event := &SkataEvent{Timestamp: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	_, err = EncodeJSON(event)
+	assert.Error(t, err)
+}
+
+func TestFormatFrame(t *testing.T) {
+	request := &SkataRequest{SkataMessageBase: goldenBase, Request: Status, ID: "call-1"}
+	expected := `{
+  "type": "Request",
+  "source": "0x0000015a995c0002",
+  "request": "Status",
+  "id": "call-1"
+}`
+	formatted, err := FormatMessage(request)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, formatted)
+
+	jsonFrame, err := appendJSONFrame(nil, request)
+	assert.NoError(t, err)
+	for _, frame := range [][]byte{appendFrame(nil, request), jsonFrame} {
+		formatted, err = FormatFrame(frame)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, formatted)
+	}
+	_, err = FormatFrame(appendFrame(nil, request)[:20])
+	assert.Error(t, err)
+}
+
+func TestJSONCodecNegotiation(t *testing.T) {
+	config := *DefaultConnectionConfig
+	config.JSONCodec = true
+	client, server, cleanup := setupPair(t, &config, &config)
+	defer cleanup()
+	assert.True(t, client.Features().Has(FeatureJSON))
+	assert.True(t, server.Features().Has(FeatureJSON))
+
+	frame := client.encode(&SkataSignal{Signal: Ping})
+	assert.Equal(t, byte(jsonPacketStart), frame.data[frameHeaderSize])
+	frame.release()
+
+	event := &SkataEvent{Timestamp: time.Unix(1520000000, 0).UTC(), EventName: "job.started"}
+	event.SetAttribute("host", StringValue("db-1"))
+	assert.NoError(t, client.Write(event))
+	received := (<-server.Pipe).(*SkataEvent)
+	assert.Equal(t, event.EventName, received.EventName)
+	assert.Equal(t, event.Attributes, received.Attributes)
+
+	// the codec is only used if both sides offer it
+	client, server, cleanup = setupPair(t, &config, nil)
+	defer cleanup()
+	assert.False(t, client.Features().Has(FeatureJSON))
+	assert.False(t, server.Features().Has(FeatureJSON))
+
+	// and JSON from a peer that didn't negotiate it is dropped
+	jsonFrame, err := appendJSONFrame(nil, &SkataEvent{EventName: "job.started"})
+	assert.NoError(t, err)
+	assert.NoError(t, client.writeFrame(jsonFrame))
+	assert.NoError(t, client.Write(&SkataEvent{EventName: "job.finished"}))
+	assert.Equal(t, "job.finished", (<-server.Pipe).(*SkataEvent).EventName)
+	assert.Equal(t, uint64(1), server.Stats().MalformedFrames)
+}
+
+func TestJSONHandshakeReplyIsBinary(t *testing.T) {
+	config := *DefaultConnectionConfig
+	config.JSONCodec = true
+	listener, err := NewListener("127.0.0.1:0", &config)
+	assert.NoError(t, err)
+	defer listener.Close()
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	handshake := &SkataHandshake{Version: common.ProtocolVersion, MinVersion: common.MinProtocolVersion, Features: FeatureJSON}
+	handshake.source = common.GenerateID(common.WorkerNode)
+	_, err = conn.Write(appendFrame(nil, handshake))
+	assert.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := readFrame(conn, config.MaxFrameSize)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, byte(Handshake), packet[0])
+	reply, err := parsePacket(packet)
+	assert.NoError(t, err)
+	assert.Equal(t, FeatureJSON, reply.(*SkataHandshake).Features)
+	server := <-listener.ConnectionChan
+	defer server.Close()
+	assert.True(t, server.Features().Has(FeatureJSON))
+}
@@ -0,0 +1,70 @@
+package comms
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrKeepaliveTimeout is reported when the peer stopped answering pings
+var ErrKeepaliveTimeout = errors.New("comms: peer stopped answering pings")
+
+// RTT returns the round trip time measured by the last answered
+// ping, or zero if no ping has been answered yet
+func (c *Connection) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// startKeepalive starts pinging the peer once the handshake has
+// negotiated keepalives
+func (c *Connection) startKeepalive() {
+	if c.Features().Has(FeatureKeepalive) && c.config.KeepaliveInterval > 0 {
+		go c.keepalive(c.config.KeepaliveInterval)
+	}
+}
+
+func (c *Connection) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.inboundStalled.Load() {
+				// the pongs are waiting behind messages the
+				// application hasn't taken yet, which doesn't
+				// make the peer dead
+				atomic.StoreInt32(&c.unansweredPings, 0)
+			}
+			missed := int(atomic.AddInt32(&c.unansweredPings, 1)) - 1
+			if c.config.MaxMissedPongs > 0 && missed >= c.config.MaxMissedPongs {
+				c.shutdown(ErrKeepaliveTimeout)
+				return
+			}
+			atomic.StoreInt64(&c.pingSent, time.Now().UnixNano())
+			c.Write(&SkataSignal{Signal: Ping})
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+// handleKeepalive answers pings and records pongs. It reports
+// whether msg was a keepalive signal. Pongs are queued without
+// waiting, a peer whose pongs are dropped because our outbound
+// queue is full still sees our other frames.
+func (c *Connection) handleKeepalive(msg SkataMessage) bool {
+	signal, ok := msg.(*SkataSignal)
+	if !ok {
+		return false
+	}
+	switch signal.Signal {
+	case Ping:
+		c.writeControl(&SkataSignal{Signal: Pong})
+	case Pong:
+		sent := atomic.LoadInt64(&c.pingSent)
+		atomic.StoreInt64(&c.rtt, time.Now().UnixNano()-sent)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package comms
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepaliveRTT(t *testing.T) {
+	config := *DefaultConnectionConfig
+	config.KeepaliveInterval = time.Millisecond * 10
+	// only measure, a busy machine may well miss a few pongs
+	config.MaxMissedPongs = 0
+	client, server, cleanup := setupPair(t, &config, &config)
+	defer cleanup()
+
+	assert.True(t, client.Features().Has(FeatureKeepalive))
+	assert.Eventually(t, func() bool {
+		return client.RTT() > 0 && server.RTT() > 0
+	}, time.Second, time.Millisecond)
+	// keepalive signals never reach the pipe
+	assert.Zero(t, client.Stats().InboundDepth)
+	assert.Zero(t, server.Stats().InboundDepth)
+}
+
+func TestKeepaliveDeadPeer(t *testing.T) {
+	// a client whose unbuffered pipe nobody reads stops answering
+	// pings as soon as a message is waiting on it, and without
+	// keepalives of its own it sends nothing else either
+	dialConfig := *DefaultConnectionConfig
+	dialConfig.InboundQueueSize = 0
+	dialConfig.KeepaliveInterval = 0
+	config := *DefaultConnectionConfig
+	config.KeepaliveInterval = time.Millisecond * 10
+	config.MaxMissedPongs = 2
+	_, server, cleanup := setupPair(t, &dialConfig, &config)
+	defer cleanup()
+
+	server.Write(&SkataEvent{EventName: "stall"})
+	select {
+	case <-server.Done():
+		assert.Equal(t, ErrKeepaliveTimeout, server.Err())
+	case <-time.After(time.Second):
+		t.Fatal("dead peer was not detected")
+	}
+}
+
+func TestKeepaliveSlowConsumer(t *testing.T) {
+	// a client that is slow to read its pipe but keeps pinging
+	// is alive, and doesn't give up on the server either
+	config := *DefaultConnectionConfig
+	config.InboundQueueSize = 0
+	config.KeepaliveInterval = time.Millisecond * 20
+	// generous for a busy machine, yet either side would give up
+	// well within the stall if it counted the stuck pongs
+	config.MaxMissedPongs = 5
+	client, server, cleanup := setupPair(t, &config, &config)
+	defer cleanup()
+
+	assert.NoError(t, server.Write(&SkataEvent{EventName: "stall"}))
+	select {
+	case <-server.Done():
+		t.Fatalf("slow consumer was closed: %v", server.Err())
+	case <-client.Done():
+		t.Fatalf("client gave up: %v", client.Err())
+	case <-time.After(time.Millisecond * 400):
+	}
+	assert.Equal(t, "stall", (<-client.Pipe).(*SkataEvent).EventName)
+}
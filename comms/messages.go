@@ -1,11 +1,17 @@
 package comms
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"skata/common"
 	"time"
 )
 
+// ErrMalformedMessage is returned when a message cannot be decoded
+var ErrMalformedMessage = errors.New("comms: malformed message")
+
 // SkataMessageType is the overriden uint type for messages
 type SkataMessageType uint
 
@@ -16,8 +22,33 @@ const (
 	Request
 	Response
 	Custom
+	Handshake
+	Error
+	StreamFrame
+	Challenge
+	Authenticate
 )
 
+var messageTypeNames = [...]string{
+	Event:        "Event",
+	Signal:       "Signal",
+	Request:      "Request",
+	Response:     "Response",
+	Custom:       "Custom",
+	Handshake:    "Handshake",
+	Error:        "Error",
+	StreamFrame:  "StreamFrame",
+	Challenge:    "Challenge",
+	Authenticate: "Authenticate",
+}
+
+func (t SkataMessageType) String() string {
+	if int(t) < len(messageTypeNames) {
+		return messageTypeNames[t]
+	}
+	return fmt.Sprintf("SkataMessageType(%d)", uint(t))
+}
+
 // SkataMessage is the message interface that all messages should have
 type SkataMessage interface {
 	Type() SkataMessageType
@@ -25,25 +56,75 @@ type SkataMessage interface {
 	Deserialize([]byte) error
 }
 
+// Appender is implemented by messages that can serialize themselves
+// into an existing buffer. All built-in messages implement it, which
+// lets connections frame them without extra copies.
+type Appender interface {
+	AppendTo(data []byte) []byte
+}
+
+// validator is implemented by messages that can hold values their
+// encoding can't carry. Write refuses them rather than sending
+// something the peer has to drop.
+type validator interface {
+	validate() error
+}
+
+// cloneBytes copies decoded data out of the frame buffer
+func cloneBytes(data []byte) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	return append(make([]byte, 0, len(data)), data...)
+}
+
 // SkataMessageBase is the base message structure
 // from which all other message types should be composed
 type SkataMessageBase struct {
 	source common.SkataNodeID
 }
 
+// Source returns the ID of the node that sent the message
+func (m SkataMessageBase) Source() common.SkataNodeID {
+	return m.source
+}
+
 // SignalType is the type alias for defining signals
 type SignalType uint8
 
 // Defined Signal types
 const (
 	Hello SignalType = iota
+	// Ping asks the peer to answer with a Pong
+	Ping
+	// Pong answers a Ping
+	Pong
+	// Drain asks the peer to finish its work and shut down
+	Drain
+	// Goodbye tells the peer nothing more will be sent
+	Goodbye
 )
 
+var signalNames = [...]string{
+	Hello:   "Hello",
+	Ping:    "Ping",
+	Pong:    "Pong",
+	Drain:   "Drain",
+	Goodbye: "Goodbye",
+}
+
+func (s SignalType) String() string {
+	if int(s) < len(signalNames) {
+		return signalNames[s]
+	}
+	return fmt.Sprintf("SignalType(%d)", uint8(s))
+}
+
 // SkataSignal is a signal that the receiver MUST treat as
 // a command.
 type SkataSignal struct {
 	SkataMessageBase
-	Signal SignalType
+	Signal SignalType `json:"signal"`
 }
 
 // Type satisfies the message interface
@@ -52,28 +133,37 @@ func (s SkataSignal) Type() SkataMessageType {
 }
 
 // Serialize Satisfies the message interface
-func (s *SkataSignal) Serialize() (data []byte) {
-	data = make([]byte, 9)
-	binary.BigEndian.PutUint64(data, uint64(s.source))
-	data[8] = byte(s.Signal)
-	return
+func (s *SkataSignal) Serialize() []byte {
+	return s.AppendTo(nil)
+}
+
+// AppendTo satisfies the Appender interface
+func (s *SkataSignal) AppendTo(data []byte) []byte {
+	data = binary.BigEndian.AppendUint64(data, uint64(s.source))
+	return append(data, byte(s.Signal))
 }
 
 // Deserialize Satisfies the message interface
 func (s *SkataSignal) Deserialize(data []byte) (err error) {
-	s.source = common.SkataNodeID(binary.BigEndian.Uint64(data[:8]))
-	s.Signal = SignalType(data[8])
-	return
+	r := wireReader{data: data}
+	s.source = common.SkataNodeID(r.uint64())
+	s.Signal = SignalType(r.byte())
+	return r.end()
 }
 
 // SkataEvent is an arbitrary event.
 // This allows arbitrary data to be communicated by
 // the scheduler or nodes and if the nodes CAN handle it,
-// they SHOULD
+// they SHOULD. Events can carry typed Attributes and a
+// Body described by ContentType. The EventName must not
+// contain NUL bytes.
 type SkataEvent struct {
 	SkataMessageBase
-	Timestamp time.Time
-	EventName string
+	Timestamp   time.Time                 `json:"timestamp"`
+	EventName   string                    `json:"eventName"`
+	Attributes  map[string]AttributeValue `json:"attributes,omitempty"`
+	ContentType string                    `json:"contentType,omitempty"`
+	Body        []byte                    `json:"body,omitempty"`
 }
 
 // Type satisfies the message interface
@@ -81,29 +171,47 @@ func (s SkataEvent) Type() SkataMessageType {
 	return Event
 }
 
-// Serialize Satisfies the message interface
-func (s *SkataEvent) Serialize() (data []byte) {
-	data = make([]byte, 8)
-	binary.BigEndian.PutUint64(data, uint64(s.source))
+// Serialize Satisfies the message interface. Events without a
+// payload encode exactly as they did before payloads existed,
+// otherwise the payload follows the name after a NUL byte.
+func (s *SkataEvent) Serialize() []byte {
+	return s.AppendTo(nil)
+}
+
+// AppendTo satisfies the Appender interface
+func (s *SkataEvent) AppendTo(data []byte) []byte {
+	data = binary.BigEndian.AppendUint64(data, uint64(s.source))
 	timeBytes, _ := s.Timestamp.MarshalBinary()
-	timeLengthBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(timeLengthBytes, uint64(len(timeBytes)))
-	timeBytes = append(timeLengthBytes, timeBytes...)
+	data = binary.BigEndian.AppendUint64(data, uint64(len(timeBytes)))
 	data = append(data, timeBytes...)
-	data = append(data, []byte(s.EventName)...)
-	return
+	data = append(data, s.EventName...)
+	if s.hasPayload() {
+		data = append(data, 0)
+		data = s.appendPayload(data)
+	}
+	return data
 }
 
 // Deserialize Satisfies the message interface
 func (s *SkataEvent) Deserialize(data []byte) (err error) {
-	s.source = common.SkataNodeID(binary.BigEndian.Uint64(data[:8]))
-	timestampLength := binary.BigEndian.Uint64(data[8:16])
-	timestamp := new(time.Time)
-	if err = timestamp.UnmarshalBinary(data[16 : 16+timestampLength]); err != nil {
-		return
+	r := wireReader{data: data}
+	s.source = common.SkataNodeID(r.uint64())
+	timeBytes := r.prefixed64()
+	if r.err != nil {
+		return r.err
+	}
+	if err = s.Timestamp.UnmarshalBinary(timeBytes); err != nil {
+		return ErrMalformedMessage
+	}
+	name := r.rest()
+	s.Attributes, s.ContentType, s.Body = nil, "", nil
+	if end := bytes.IndexByte(name, 0); end >= 0 {
+		if err = s.readPayload(&wireReader{data: name[end+1:]}); err != nil {
+			return
+		}
+		name = name[:end]
 	}
-	s.Timestamp = *timestamp
-	s.EventName = string(data[16+timestampLength:])
+	s.EventName = string(name)
 	return
 }
 
@@ -115,29 +223,44 @@ const (
 	Status RequestType = iota
 )
 
+var requestNames = [...]string{
+	Status: "Status",
+}
+
+func (r RequestType) String() string {
+	if int(r) < len(requestNames) {
+		return requestNames[r]
+	}
+	return fmt.Sprintf("RequestType(%d)", uint8(r))
+}
+
 // SkataRequest is a request to a node.
 // A node SHOULD respond to a request with a SkataResponse
 type SkataRequest struct {
 	SkataMessageBase
-	Request RequestType
-	ID      string
+	Request RequestType `json:"request"`
+	ID      string      `json:"id"`
 }
 
 // Serialize Satisfies the message interface
-func (s *SkataRequest) Serialize() (data []byte) {
-	data = make([]byte, 8)
-	binary.BigEndian.PutUint64(data, uint64(s.source))
+func (s *SkataRequest) Serialize() []byte {
+	return s.AppendTo(nil)
+}
+
+// AppendTo satisfies the Appender interface
+func (s *SkataRequest) AppendTo(data []byte) []byte {
+	data = binary.BigEndian.AppendUint64(data, uint64(s.source))
 	data = append(data, byte(s.Request))
-	data = append(data, []byte(s.ID)...)
-	return
+	return append(data, s.ID...)
 }
 
 // Deserialize Satisfies the message interface
 func (s *SkataRequest) Deserialize(data []byte) (err error) {
-	s.source = common.SkataNodeID(binary.BigEndian.Uint64(data[:8]))
-	s.Request = RequestType(data[8])
-	s.ID = string(data[9:])
-	return
+	r := wireReader{data: data}
+	s.source = common.SkataNodeID(r.uint64())
+	s.Request = RequestType(r.byte())
+	s.ID = string(r.rest())
+	return r.err
 }
 
 // Type satisfies the message interface
@@ -149,29 +272,30 @@ func (s SkataRequest) Type() SkataMessageType {
 // completes a two-way communication between nodes.
 type SkataResponse struct {
 	SkataMessageBase
-	RequestID string
-	Data      []byte
+	RequestID string `json:"requestID"`
+	Data      []byte `json:"data,omitempty"`
 }
 
 // Serialize Satisfies the message interface
-func (s *SkataResponse) Serialize() (data []byte) {
-	data = make([]byte, 8)
-	binary.BigEndian.PutUint64(data, uint64(s.source))
-	dataLengthBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(dataLengthBytes, uint64(len(s.Data)))
-	data = append(data, dataLengthBytes...)
+func (s *SkataResponse) Serialize() []byte {
+	return s.AppendTo(nil)
+}
+
+// AppendTo satisfies the Appender interface
+func (s *SkataResponse) AppendTo(data []byte) []byte {
+	data = binary.BigEndian.AppendUint64(data, uint64(s.source))
+	data = binary.BigEndian.AppendUint64(data, uint64(len(s.Data)))
 	data = append(data, s.Data...)
-	data = append(data, []byte(s.RequestID)...)
-	return
+	return append(data, s.RequestID...)
 }
 
 // Deserialize Satisfies the message interface
 func (s *SkataResponse) Deserialize(data []byte) (err error) {
-	s.source = common.SkataNodeID(binary.BigEndian.Uint64(data[:8]))
-	dataLength := binary.BigEndian.Uint64(data[8:16])
-	s.Data = data[16 : 16+dataLength]
-	s.RequestID = string(data[16+dataLength:])
-	return
+	r := wireReader{data: data}
+	s.source = common.SkataNodeID(r.uint64())
+	s.Data = cloneBytes(r.prefixed64())
+	s.RequestID = string(r.rest())
+	return r.err
 }
 
 // Type satisfies the message interface
@@ -182,7 +306,7 @@ func (s SkataResponse) Type() SkataMessageType {
 // SkataCustom is just a custom message wrapper
 type SkataCustom struct {
 	SkataMessageBase
-	Data []byte
+	Data []byte `json:"data,omitempty"`
 }
 
 // Type satisfies the message interface
@@ -191,20 +315,298 @@ func (s SkataCustom) Type() SkataMessageType {
 }
 
 // Serialize Satisfies the message interface
-func (s *SkataCustom) Serialize() (data []byte) {
-	data = make([]byte, 8)
-	binary.BigEndian.PutUint64(data, uint64(s.source))
-	dataLengthBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(dataLengthBytes, uint64(len(s.Data)))
-	data = append(data, dataLengthBytes...)
-	data = append(data, s.Data...)
-	return
+func (s *SkataCustom) Serialize() []byte {
+	return s.AppendTo(nil)
+}
+
+// AppendTo satisfies the Appender interface
+func (s *SkataCustom) AppendTo(data []byte) []byte {
+	data = binary.BigEndian.AppendUint64(data, uint64(s.source))
+	data = binary.BigEndian.AppendUint64(data, uint64(len(s.Data)))
+	return append(data, s.Data...)
 }
 
 // Deserialize Satisfies the message interface
 func (s *SkataCustom) Deserialize(data []byte) (err error) {
-	s.source = common.SkataNodeID(binary.BigEndian.Uint64(data[:8]))
-	dataLength := binary.BigEndian.Uint64(data[8:16])
-	s.Data = data[16 : 16+dataLength]
-	return
+	r := wireReader{data: data}
+	s.source = common.SkataNodeID(r.uint64())
+	s.Data = cloneBytes(r.prefixed64())
+	return r.end()
+}
+
+// Features is a bit set of optional protocol extensions
+// that peers agree on during the handshake.
+type Features uint64
+
+// Defined features
+const (
+	// FeatureStreams allows multiplexed streams on the connection
+	FeatureStreams Features = 1 << iota
+	// FeatureCompression allows DEFLATE compressed frames
+	FeatureCompression
+	// FeatureKeepalive allows Ping and Pong signals
+	FeatureKeepalive
+	// FeatureDrain allows Drain and Goodbye signals
+	FeatureDrain
+	// FeatureJSON allows messages encoded as JSON
+	FeatureJSON
+)
+
+// Has reports whether all the given feature bits are set
+func (f Features) Has(feature Features) bool {
+	return f&feature == feature
+}
+
+// SkataHandshake opens every connection. Each side announces the
+// range of protocol versions and the features it supports and the
+// listener answers with the negotiated values.
+type SkataHandshake struct {
+	SkataMessageBase
+	Version    uint8    `json:"version"`
+	MinVersion uint8    `json:"minVersion"`
+	Features   Features `json:"features"`
+}
+
+// Type satisfies the message interface
+func (s SkataHandshake) Type() SkataMessageType {
+	return Handshake
+}
+
+// Serialize Satisfies the message interface
+func (s *SkataHandshake) Serialize() []byte {
+	return s.AppendTo(nil)
+}
+
+// AppendTo satisfies the Appender interface
+func (s *SkataHandshake) AppendTo(data []byte) []byte {
+	data = binary.BigEndian.AppendUint64(data, uint64(s.source))
+	data = append(data, s.Version, s.MinVersion)
+	return binary.BigEndian.AppendUint64(data, uint64(s.Features))
+}
+
+// Deserialize Satisfies the message interface
+func (s *SkataHandshake) Deserialize(data []byte) (err error) {
+	r := wireReader{data: data}
+	s.source = common.SkataNodeID(r.uint64())
+	s.Version = r.byte()
+	s.MinVersion = r.byte()
+	s.Features = Features(r.uint64())
+	return r.end()
+}
+
+// ErrorCode identifies the reason carried by a SkataError
+type ErrorCode uint8
+
+// Defined error codes
+const (
+	ErrCodeUnknown ErrorCode = iota
+	ErrCodeVersionMismatch
+	ErrCodeProtocol
+	ErrCodeFrameTooLarge
+	ErrCodeChecksum
+	ErrCodeUnauthorized
+	ErrCodeAuthFailed
+	ErrCodeHandlerFailed
+	ErrCodeQueueFull
+)
+
+var errorCodeNames = [...]string{
+	ErrCodeUnknown:         "Unknown",
+	ErrCodeVersionMismatch: "VersionMismatch",
+	ErrCodeProtocol:        "Protocol",
+	ErrCodeFrameTooLarge:   "FrameTooLarge",
+	ErrCodeChecksum:        "Checksum",
+	ErrCodeUnauthorized:    "Unauthorized",
+	ErrCodeAuthFailed:      "AuthFailed",
+	ErrCodeHandlerFailed:   "HandlerFailed",
+	ErrCodeQueueFull:       "QueueFull",
+}
+
+func (c ErrorCode) String() string {
+	if int(c) < len(errorCodeNames) {
+		return errorCodeNames[c]
+	}
+	return fmt.Sprintf("ErrorCode(%d)", uint8(c))
+}
+
+// SkataError tells the peer that something went wrong. Errors
+// raised during the handshake are followed by the connection being
+// closed. RequestID, if set, ties the error to a SkataRequest.
+type SkataError struct {
+	SkataMessageBase
+	Code      ErrorCode `json:"code"`
+	RequestID string    `json:"requestID,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// Type satisfies the message interface
+func (s SkataError) Type() SkataMessageType {
+	return Error
+}
+
+// Error satisfies the error interface so a received SkataError
+// can be handed straight back to callers
+func (s *SkataError) Error() string {
+	return fmt.Sprintf("comms: peer error %d: %s", s.Code, s.Message)
+}
+
+// Serialize Satisfies the message interface
+func (s *SkataError) Serialize() []byte {
+	return s.AppendTo(nil)
+}
+
+// AppendTo satisfies the Appender interface
+func (s *SkataError) AppendTo(data []byte) []byte {
+	data = binary.BigEndian.AppendUint64(data, uint64(s.source))
+	data = append(data, byte(s.Code))
+	data = binary.BigEndian.AppendUint64(data, uint64(len(s.RequestID)))
+	data = append(data, s.RequestID...)
+	return append(data, s.Message...)
+}
+
+// Deserialize Satisfies the message interface
+func (s *SkataError) Deserialize(data []byte) (err error) {
+	r := wireReader{data: data}
+	s.source = common.SkataNodeID(r.uint64())
+	s.Code = ErrorCode(r.byte())
+	s.RequestID = string(r.prefixed64())
+	s.Message = string(r.rest())
+	return r.err
+}
+
+// StreamOp is the operation carried by a SkataStreamFrame
+type StreamOp uint8
+
+// Defined stream operations
+const (
+	// StreamOpen opens a stream, Increment is the opener's receive window
+	StreamOpen StreamOp = iota
+	// StreamData carries a chunk of stream data
+	StreamData
+	// StreamWindow grants the peer Increment more bytes of send window
+	StreamWindow
+	// StreamClose marks the end of the data sent by one side
+	StreamClose
+	// StreamReset aborts the stream in both directions
+	StreamReset
+)
+
+var streamOpNames = [...]string{
+	StreamOpen:   "Open",
+	StreamData:   "Data",
+	StreamWindow: "Window",
+	StreamClose:  "Close",
+	StreamReset:  "Reset",
+}
+
+func (o StreamOp) String() string {
+	if int(o) < len(streamOpNames) {
+		return streamOpNames[o]
+	}
+	return fmt.Sprintf("StreamOp(%d)", uint8(o))
+}
+
+// SkataStreamFrame carries one operation on a multiplexed stream
+type SkataStreamFrame struct {
+	SkataMessageBase
+	StreamID  uint32   `json:"streamID"`
+	Op        StreamOp `json:"op"`
+	Increment uint32   `json:"increment"`
+	Data      []byte   `json:"data,omitempty"`
+}
+
+// Type satisfies the message interface
+func (s SkataStreamFrame) Type() SkataMessageType {
+	return StreamFrame
+}
+
+// Serialize Satisfies the message interface
+func (s *SkataStreamFrame) Serialize() []byte {
+	return s.AppendTo(make([]byte, 0, 17+len(s.Data)))
+}
+
+// AppendTo satisfies the Appender interface
+func (s *SkataStreamFrame) AppendTo(data []byte) []byte {
+	data = binary.BigEndian.AppendUint64(data, uint64(s.source))
+	data = binary.BigEndian.AppendUint32(data, s.StreamID)
+	data = append(data, byte(s.Op))
+	data = binary.BigEndian.AppendUint32(data, s.Increment)
+	return append(data, s.Data...)
+}
+
+// Deserialize Satisfies the message interface
+func (s *SkataStreamFrame) Deserialize(data []byte) (err error) {
+	r := wireReader{data: data}
+	s.source = common.SkataNodeID(r.uint64())
+	s.StreamID = r.uint32()
+	s.Op = StreamOp(r.byte())
+	s.Increment = r.uint32()
+	s.Data = cloneBytes(r.rest())
+	return r.err
+}
+
+// SkataChallenge is sent by a listener that requires authentication.
+// The dialer has to answer with a SkataAuthenticate over the nonce.
+type SkataChallenge struct {
+	SkataMessageBase
+	Nonce []byte `json:"nonce"`
+}
+
+// Type satisfies the message interface
+func (s SkataChallenge) Type() SkataMessageType {
+	return Challenge
+}
+
+// Serialize Satisfies the message interface
+func (s *SkataChallenge) Serialize() []byte {
+	return s.AppendTo(make([]byte, 0, 8+len(s.Nonce)))
+}
+
+// AppendTo satisfies the Appender interface
+func (s *SkataChallenge) AppendTo(data []byte) []byte {
+	data = binary.BigEndian.AppendUint64(data, uint64(s.source))
+	return append(data, s.Nonce...)
+}
+
+// Deserialize Satisfies the message interface
+func (s *SkataChallenge) Deserialize(data []byte) (err error) {
+	r := wireReader{data: data}
+	s.source = common.SkataNodeID(r.uint64())
+	s.Nonce = cloneBytes(r.rest())
+	return r.err
+}
+
+// SkataAuthenticate answers a SkataChallenge with a MAC computed
+// using the cluster key identified by KeyID
+type SkataAuthenticate struct {
+	SkataMessageBase
+	KeyID string `json:"keyID"`
+	MAC   []byte `json:"mac"`
+}
+
+// Type satisfies the message interface
+func (s SkataAuthenticate) Type() SkataMessageType {
+	return Authenticate
+}
+
+// Serialize Satisfies the message interface
+func (s *SkataAuthenticate) Serialize() []byte {
+	return s.AppendTo(make([]byte, 0, 16+len(s.KeyID)+len(s.MAC)))
+}
+
+// AppendTo satisfies the Appender interface
+func (s *SkataAuthenticate) AppendTo(data []byte) []byte {
+	data = binary.BigEndian.AppendUint64(data, uint64(s.source))
+	data = binary.BigEndian.AppendUint64(data, uint64(len(s.KeyID)))
+	data = append(data, s.KeyID...)
+	return append(data, s.MAC...)
+}
+
+// Deserialize Satisfies the message interface
+func (s *SkataAuthenticate) Deserialize(data []byte) (err error) {
+	r := wireReader{data: data}
+	s.source = common.SkataNodeID(r.uint64())
+	s.KeyID = string(r.prefixed64())
+	s.MAC = cloneBytes(r.rest())
+	return r.err
 }
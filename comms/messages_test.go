@@ -24,7 +24,8 @@ func TestSkataSignal(t *testing.T) {
 func TestSkataEvent(t *testing.T) {
 	event := new(SkataEvent)
 	event.EventName = "test"
-	event.Timestamp = time.Now()
+	// the monotonic clock reading never goes over the wire
+	event.Timestamp = time.Now().Round(0)
 	event.source = common.GenerateID(common.HubNode)
 
 	eventBytes := event.Serialize()
@@ -75,3 +76,120 @@ func TestSkataCustom(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, newMessage, message)
 }
+
+func TestSkataHandshake(t *testing.T) {
+	handshake := new(SkataHandshake)
+	handshake.source = common.GenerateID(common.HubNode)
+	handshake.Version = 2
+	handshake.MinVersion = 1
+	handshake.Features = 0x5
+
+	newHandshake := new(SkataHandshake)
+	err := newHandshake.Deserialize(handshake.Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, newHandshake, handshake)
+}
+
+func TestSkataError(t *testing.T) {
+	message := new(SkataError)
+	message.source = common.GenerateID(common.HubNode)
+	message.Code = ErrCodeVersionMismatch
+	message.RequestID = "1234"
+	message.Message = "test"
+
+	newMessage := new(SkataError)
+	err := newMessage.Deserialize(message.Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, newMessage, message)
+}
+
+func TestSkataAuthenticate(t *testing.T) {
+	challenge := new(SkataChallenge)
+	challenge.source = common.GenerateID(common.HubNode)
+	challenge.Nonce = []byte("nonce")
+
+	newChallenge := new(SkataChallenge)
+	err := newChallenge.Deserialize(challenge.Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, newChallenge, challenge)
+
+	answer := new(SkataAuthenticate)
+	answer.source = common.GenerateID(common.WorkerNode)
+	answer.KeyID = "2018-01"
+	answer.MAC = []byte("mac")
+
+	newAnswer := new(SkataAuthenticate)
+	err = newAnswer.Deserialize(answer.Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, newAnswer, answer)
+}
+
+func TestSkataEventPayload(t *testing.T) {
+	event := new(SkataEvent)
+	event.EventName = "job.backup.failed"
+	event.Timestamp = time.Unix(1520000000, 0).UTC()
+	event.source = common.GenerateID(common.WorkerNode)
+	event.SetAttribute("host", StringValue("db-1"))
+	event.SetAttribute("attempt", IntValue(-3))
+	event.SetAttribute("load", FloatValue(0.75))
+	event.SetAttribute("retry", BoolValue(true))
+	event.SetAttribute("digest", BytesValue([]byte{1, 2, 3}))
+	event.SetAttribute("started", TimeValue(time.Unix(1519990000, 0).UTC()))
+	event.ContentType = "text/plain"
+	event.Body = []byte("disk full")
+
+	newEvent := new(SkataEvent)
+	err := newEvent.Deserialize(event.Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, event, newEvent)
+
+	host, ok := newEvent.GetString("host")
+	assert.True(t, ok)
+	assert.Equal(t, "db-1", host)
+	attempt, _ := newEvent.GetInt("attempt")
+	assert.Equal(t, int64(-3), attempt)
+	load, _ := newEvent.GetFloat("load")
+	assert.Equal(t, 0.75, load)
+	retry, _ := newEvent.GetBool("retry")
+	assert.True(t, retry)
+	started, _ := newEvent.GetTime("started")
+	assert.Equal(t, int64(1519990000), started.Unix())
+	_, ok = newEvent.GetInt("host")
+	assert.False(t, ok)
+	_, ok = newEvent.GetBytes("missing")
+	assert.False(t, ok)
+
+	data := event.Serialize()
+	err = newEvent.Deserialize(data[:len(data)-1])
+	assert.Equal(t, ErrBadLength, err)
+	assert.ErrorIs(t, err, ErrMalformedMessage)
+}
+
+func TestSkataEventWithoutPayload(t *testing.T) {
+	event := new(SkataEvent)
+	event.EventName = "test"
+	event.Timestamp = time.Unix(1520000000, 0).UTC()
+
+	// plain events keep the original encoding, name up to the end
+	data := event.Serialize()
+	assert.Equal(t, []byte("test"), data[len(data)-4:])
+
+	newEvent := new(SkataEvent)
+	assert.NoError(t, newEvent.Deserialize(data))
+	assert.Equal(t, event, newEvent)
+}
+
+func TestInvalidEventsAreRejected(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+
+	assert.Equal(t, ErrInvalidEvent, client.Write(&SkataEvent{EventName: "job\x00started"}))
+	event := &SkataEvent{EventName: "job.started"}
+	event.SetAttribute("host", AttributeValue{})
+	assert.Equal(t, ErrInvalidEvent, client.Write(event))
+
+	event.SetAttribute("host", StringValue("db-1"))
+	assert.NoError(t, client.Write(event))
+	received := (<-server.Pipe).(*SkataEvent)
+	assert.Equal(t, event.Attributes, received.Attributes)
+}
@@ -0,0 +1,147 @@
+package comms
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps a Handler to add behaviour around it
+type Middleware func(Handler) Handler
+
+// Chain composes middleware into one, the first being the outermost
+func Chain(middleware ...Middleware) Middleware {
+	return func(handler Handler) Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			handler = middleware[i](handler)
+		}
+		return handler
+	}
+}
+
+// WrapEventHandler applies middleware to a single EventHandler
+func WrapEventHandler(handler EventHandler, middleware ...Middleware) EventHandler {
+	wrapped := Chain(middleware...)(func(msg SkataMessage) error {
+		return handler(msg.(*SkataEvent))
+	})
+	return func(event *SkataEvent) error {
+		return wrapped(event)
+	}
+}
+
+// WrapSignalHandler applies middleware to a single SignalHandler
+func WrapSignalHandler(handler SignalHandler, middleware ...Middleware) SignalHandler {
+	wrapped := Chain(middleware...)(func(msg SkataMessage) error {
+		return handler(msg.(*SkataSignal))
+	})
+	return func(signal *SkataSignal) error {
+		return wrapped(signal)
+	}
+}
+
+// WrapRequestHandler applies middleware to a single RequestHandler
+func WrapRequestHandler(handler RequestHandler, middleware ...Middleware) RequestHandler {
+	wrapped := Chain(middleware...)(func(msg SkataMessage) error {
+		return handler(msg.(*SkataRequest))
+	})
+	return func(request *SkataRequest) error {
+		return wrapped(request)
+	}
+}
+
+// WrapCustomHandler applies middleware to a single CustomHandler
+func WrapCustomHandler(handler CustomHandler, middleware ...Middleware) CustomHandler {
+	wrapped := Chain(middleware...)(func(msg SkataMessage) error {
+		return handler(msg.(*SkataCustom))
+	})
+	return func(custom *SkataCustom) error {
+		return wrapped(custom)
+	}
+}
+
+// PanicError is returned by the Recovery middleware in place
+// of a handler that panicked
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("comms: handler panicked: %v", p.Value)
+}
+
+// Recovery turns handler panics into a *PanicError
+func Recovery() Middleware {
+	return func(next Handler) Handler {
+		return func(msg SkataMessage) (err error) {
+			defer func() {
+				if value := recover(); value != nil {
+					err = &PanicError{Value: value, Stack: debug.Stack()}
+				}
+			}()
+			return next(msg)
+		}
+	}
+}
+
+// Logging logs every handled message with its duration and
+// outcome. If logger is nil the standard logger is used.
+func Logging(logger *log.Logger) Middleware {
+	logf := log.Printf
+	if logger != nil {
+		logf = logger.Printf
+	}
+	return func(next Handler) Handler {
+		return func(msg SkataMessage) error {
+			start := time.Now()
+			err := next(msg)
+			if err != nil {
+				logf("comms: handled %s in %s: %v", msg.Type(), time.Since(start), err)
+			} else {
+				logf("comms: handled %s in %s", msg.Type(), time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// HandlerMetrics are counters collected by the Metrics middleware.
+// They are safe to read while handlers run.
+type HandlerMetrics struct {
+	handled  uint64
+	failed   uint64
+	duration int64
+}
+
+// Handled returns the number of messages handled
+func (m *HandlerMetrics) Handled() uint64 {
+	return atomic.LoadUint64(&m.handled)
+}
+
+// Failed returns the number of handlers that returned an error
+func (m *HandlerMetrics) Failed() uint64 {
+	return atomic.LoadUint64(&m.failed)
+}
+
+// Duration returns the total time spent in handlers
+func (m *HandlerMetrics) Duration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.duration))
+}
+
+// Metrics counts handled messages, failures and time spent into metrics
+func Metrics(metrics *HandlerMetrics) Middleware {
+	return func(next Handler) Handler {
+		return func(msg SkataMessage) error {
+			start := time.Now()
+			err := next(msg)
+			atomic.AddInt64(&metrics.duration, int64(time.Since(start)))
+			atomic.AddUint64(&metrics.handled, 1)
+			if err != nil {
+				atomic.AddUint64(&metrics.failed, 1)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package comms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(msg SkataMessage) error {
+				calls = append(calls, name)
+				return next(msg)
+			}
+		}
+	}
+	handler := WrapEventHandler(func(*SkataEvent) error {
+		calls = append(calls, "handler")
+		return nil
+	}, trace("outer"), trace("inner"))
+	assert.NoError(t, handler(new(SkataEvent)))
+	assert.Equal(t, []string{"outer", "inner", "handler"}, calls)
+}
+
+func TestBuiltinMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	metrics := new(HandlerMetrics)
+	failure := errors.New("failed")
+	handler := WrapRequestHandler(func(request *SkataRequest) error {
+		if request.ID == "panic" {
+			panic("boom")
+		}
+		if request.ID == "fail" {
+			return failure
+		}
+		return nil
+	}, Metrics(metrics), Logging(log.New(&logs, "", 0)), Recovery())
+
+	assert.NoError(t, handler(&SkataRequest{ID: "ok"}))
+	assert.Equal(t, failure, handler(&SkataRequest{ID: "fail"}))
+	err := handler(&SkataRequest{ID: "panic"})
+	if assert.IsType(t, new(PanicError), err) {
+		assert.Equal(t, "boom", err.(*PanicError).Value)
+	}
+
+	assert.Equal(t, uint64(3), metrics.Handled())
+	assert.Equal(t, uint64(2), metrics.Failed())
+	assert.Contains(t, logs.String(), "handled Request in")
+	assert.Contains(t, logs.String(), "handler panicked: boom")
+}
+
+func TestGlobalMiddleware(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+
+	metrics := new(HandlerMetrics)
+	handler := &MessageHandler{
+		SignalHandlers: map[SignalType]SignalHandler{Hello: func(*SkataSignal) error {
+			panic("boom")
+		}},
+		Middleware: []Middleware{Metrics(metrics), Recovery()},
+	}
+	go server.Serve(context.Background(), handler)
+	client.Write(&SkataSignal{Signal: Hello})
+	client.Write(&SkataEvent{EventName: "unhandled"})
+	assert.Eventually(t, func() bool {
+		return metrics.Handled() == 2 && metrics.Failed() == 1
+	}, time.Second, time.Millisecond*10)
+}
@@ -0,0 +1,79 @@
+package comms
+
+import "errors"
+
+// ErrUnknownPriority is returned for priorities outside the defined lanes
+var ErrUnknownPriority = errors.New("comms: unknown priority")
+
+// Priority picks the outbound lane of a message. The writer always
+// sends queued control frames first, then normal ones, then bulk
+// ones, so a large upload can't delay liveness checks by more than
+// the frame being written.
+type Priority uint8
+
+// Defined priorities
+const (
+	// PriorityControl is used for signals, the handshake and
+	// Status requests
+	PriorityControl Priority = iota
+	// PriorityNormal is used for events, requests, responses and errors
+	PriorityNormal
+	// PriorityBulk is used for custom messages and stream data
+	PriorityBulk
+	priorityLanes
+)
+
+// messagePriority is the priority Write sends msg with. Stream
+// frames stay on one lane to keep their order, except for window
+// updates which only unblock the peer. Drain and Goodbye go last
+// so they follow the work queued before them.
+func messagePriority(msg SkataMessage) Priority {
+	switch typedMsg := msg.(type) {
+	case *SkataSignal:
+		if typedMsg.Signal == Drain || typedMsg.Signal == Goodbye {
+			return PriorityBulk
+		}
+		return PriorityControl
+	case *SkataHandshake, *SkataChallenge, *SkataAuthenticate:
+		return PriorityControl
+	case *SkataRequest:
+		if typedMsg.Request == Status {
+			return PriorityControl
+		}
+	case *SkataCustom:
+		return PriorityBulk
+	case *SkataStreamFrame:
+		if typedMsg.Op == StreamWindow {
+			return PriorityControl
+		}
+		return PriorityBulk
+	}
+	return PriorityNormal
+}
+
+// nextFrame waits for the next frame to write, taking it from the
+// most urgent lane that has one. It returns false once the
+// connection is closing.
+func (c *Connection) nextFrame() (frame outboundFrame, ok bool) {
+	control, normal, bulk := c.outbound[PriorityControl], c.outbound[PriorityNormal], c.outbound[PriorityBulk]
+	select {
+	case frame = <-control:
+		return frame, true
+	default:
+	}
+	select {
+	case frame = <-control:
+		return frame, true
+	case frame = <-normal:
+		return frame, true
+	default:
+	}
+	select {
+	case frame = <-control:
+	case frame = <-normal:
+	case frame = <-bulk:
+	case <-c.closing:
+		return frame, false
+	}
+	return frame, true
+}
@@ -0,0 +1,48 @@
+package comms
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessagePriority(t *testing.T) {
+	assert.Equal(t, PriorityControl, messagePriority(&SkataSignal{Signal: Ping}))
+	assert.Equal(t, PriorityBulk, messagePriority(&SkataSignal{Signal: Drain}))
+	assert.Equal(t, PriorityControl, messagePriority(&SkataRequest{Request: Status}))
+	assert.Equal(t, PriorityNormal, messagePriority(&SkataResponse{}))
+	assert.Equal(t, PriorityNormal, messagePriority(&SkataEvent{}))
+	assert.Equal(t, PriorityBulk, messagePriority(&SkataCustom{}))
+	assert.Equal(t, PriorityBulk, messagePriority(&SkataStreamFrame{Op: StreamData}))
+	assert.Equal(t, PriorityControl, messagePriority(&SkataStreamFrame{Op: StreamWindow}))
+}
+
+func TestControlPreemptsBulk(t *testing.T) {
+	// an unbuffered client pipe holds the first frame and stalls
+	// the server writer on the second
+	dialConfig := *DefaultConnectionConfig
+	dialConfig.InboundQueueSize = 0
+	client, server, cleanup := setupPair(t, &dialConfig, nil)
+	defer cleanup()
+
+	for _, data := range []string{"1", "2", "3", "4"} {
+		assert.NoError(t, server.Write(&SkataCustom{Data: []byte(data)}))
+	}
+	assert.Eventually(t, func() bool {
+		return server.Stats().OutboundDepth == 2
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, server.Write(&SkataRequest{Request: Status}))
+	assert.Equal(t, ErrUnknownPriority, server.WritePriority(&SkataCustom{}, priorityLanes))
+
+	var order []string
+	for i := 0; i < 5; i++ {
+		switch msg := (<-client.Pipe).(type) {
+		case *SkataCustom:
+			order = append(order, string(msg.Data))
+		case *SkataRequest:
+			order = append(order, "status")
+		}
+	}
+	assert.Equal(t, []string{"1", "2", "status", "3", "4"}, order)
+}
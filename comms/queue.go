@@ -0,0 +1,224 @@
+package comms
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrQueueFull is returned when a message could not be queued
+// because the queue was full
+var ErrQueueFull = errors.New("comms: queue full")
+
+// QueuePolicy decides what happens to a message arriving at a full queue
+type QueuePolicy uint8
+
+// Queue policies
+const (
+	// QueueBlock waits until there is room in the queue
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest discards the longest waiting message to make room
+	QueueDropOldest
+	// QueueDropNewest discards the arriving message
+	QueueDropNewest
+	// QueueDisconnect closes the connection
+	QueueDisconnect
+)
+
+// undroppable reports whether msg is exempt from the drop
+// policies. Losing one of these would corrupt a stream or stall
+// the handshake or the shutdown, so they wait for room instead.
+func undroppable(msg SkataMessage) bool {
+	switch typedMsg := msg.(type) {
+	case *SkataStreamFrame, *SkataHandshake, *SkataChallenge, *SkataAuthenticate:
+		return true
+	case *SkataSignal:
+		return typedMsg.Signal == Hello || typedMsg.Signal == Drain || typedMsg.Signal == Goodbye
+	}
+	return false
+}
+
+// outboundFrame is an encoded frame waiting for the writer. If
+// sent is set it is closed once the frame has been written. The
+// pooled buffer the frame was built in, if any, is released once
+// the frame is no longer needed. Pinned frames count against pin
+// until then, see pin.
+type outboundFrame struct {
+	data   []byte
+	buffer *[]byte
+	sent   chan struct{}
+	pin    *atomic.Int32
+}
+
+func (f outboundFrame) release() {
+	if f.pin != nil {
+		f.pin.Add(-1)
+	}
+	if f.buffer != nil {
+		putBuffer(f.buffer)
+	}
+}
+
+// pin keeps frame from being evicted by QueueDropOldest. No frame
+// is evicted from a lane while it holds a pinned frame, which
+// spares keeping track of where they are.
+func (c *Connection) pin(frame *outboundFrame, priority Priority) {
+	c.evictLock.Lock()
+	c.pinned[priority].Add(1)
+	c.evictLock.Unlock()
+	frame.pin = &c.pinned[priority]
+}
+
+// evictOutbound discards the longest waiting frame of the lane. It
+// returns false if the lane is empty or holds pinned frames.
+func (c *Connection) evictOutbound(priority Priority) bool {
+	c.evictLock.Lock()
+	defer c.evictLock.Unlock()
+	if c.pinned[priority].Load() > 0 {
+		return false
+	}
+	select {
+	case dropped := <-c.outbound[priority]:
+		dropped.release()
+		atomic.AddUint64(&c.stats.OutboundDropped, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueueInbound hands a received message to Pipe according to
+// InboundPolicy. It returns false once the read loop has to stop.
+// Undroppable messages wait for room unless the policy disconnects,
+// and nothing is evicted while one of them is waiting in Pipe for
+// the handshake.
+func (c *Connection) enqueueInbound(msg SkataMessage) bool {
+	policy := c.config.InboundPolicy
+	if undroppable(msg) {
+		c.pinnedInbound.Add(1)
+		if policy != QueueDisconnect {
+			policy = QueueBlock
+		}
+	}
+	for {
+		select {
+		case c.Pipe <- msg:
+			return true
+		default:
+		}
+		switch policy {
+		case QueueBlock:
+			// pongs can't be read meanwhile, see keepalive
+			c.inboundStalled.Store(true)
+			defer c.inboundStalled.Store(false)
+			select {
+			case c.Pipe <- msg:
+				return true
+			case <-c.closing:
+				return false
+			}
+		case QueueDropOldest:
+			if c.pinnedInbound.Load() > 0 {
+				policy = QueueBlock
+				continue
+			}
+			select {
+			case <-c.Pipe:
+				atomic.AddUint64(&c.stats.InboundDropped, 1)
+				continue
+			default:
+			}
+		case QueueDisconnect:
+			c.writeNow(&SkataError{Code: ErrCodeQueueFull, Message: ErrQueueFull.Error()})
+			c.shutdown(ErrQueueFull)
+			return false
+		}
+		atomic.AddUint64(&c.stats.InboundDropped, 1)
+		return true
+	}
+}
+
+// enqueueOutbound hands an encoded frame to the writer, on the
+// lane of the given priority, according to OutboundPolicy. Pinned
+// frames wait for room unless the policy disconnects.
+func (c *Connection) enqueueOutbound(frame outboundFrame, priority Priority) error {
+	lane := c.outbound[priority]
+	policy := c.config.OutboundPolicy
+	if frame.pin != nil && policy != QueueDisconnect {
+		policy = QueueBlock
+	}
+	for {
+		select {
+		case lane <- frame:
+			return nil
+		default:
+		}
+		switch policy {
+		case QueueBlock:
+			select {
+			case lane <- frame:
+				return nil
+			case <-c.closing:
+				return ErrConnectionClosed
+			}
+		case QueueDropOldest:
+			if c.evictOutbound(priority) {
+				continue
+			}
+			if c.pinned[priority].Load() > 0 {
+				policy = QueueBlock
+				continue
+			}
+		case QueueDisconnect:
+			c.shutdown(ErrQueueFull)
+			return ErrQueueFull
+		}
+		atomic.AddUint64(&c.stats.OutboundDropped, 1)
+		return ErrQueueFull
+	}
+}
+
+// writeControl queues a reply the read loop owes the peer. It never
+// waits for room, since the writer may in turn be waiting for the
+// peer to read, which it only does while our read loop runs. If the
+// lane is full the message is dropped and false is returned.
+func (c *Connection) writeControl(msg SkataMessage) bool {
+	select {
+	case <-c.closing:
+		return false
+	default:
+	}
+	frame := c.encode(msg)
+	priority := messagePriority(msg)
+	if undroppable(msg) {
+		c.pin(&frame, priority)
+	}
+	select {
+	case c.outbound[priority] <- frame:
+		return true
+	default:
+	}
+	frame.release()
+	atomic.AddUint64(&c.stats.OutboundDropped, 1)
+	return false
+}
+
+// writeRoutine writes queued frames until the connection closes
+func (c *Connection) writeRoutine() {
+	for {
+		frame, ok := c.nextFrame()
+		if !ok {
+			return
+		}
+		if frame.data != nil {
+			if err := c.writeFrame(frame.data); err != nil {
+				frame.release()
+				c.shutdown(err)
+				return
+			}
+		}
+		frame.release()
+		if frame.sent != nil {
+			close(frame.sent)
+		}
+	}
+}
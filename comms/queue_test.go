@@ -0,0 +1,159 @@
+package comms
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInboundDropOldest(t *testing.T) {
+	config := *DefaultConnectionConfig
+	config.InboundQueueSize = 2
+	config.InboundPolicy = QueueDropOldest
+	client, server, cleanup := setupPair(t, nil, &config)
+	defer cleanup()
+
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(t, client.Write(&SkataEvent{EventName: name}))
+	}
+	assert.Eventually(t, func() bool {
+		return server.Stats().InboundDropped == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 2, server.Stats().InboundDepth)
+	assert.Equal(t, "d", (<-server.Pipe).(*SkataEvent).EventName)
+	assert.Equal(t, "e", (<-server.Pipe).(*SkataEvent).EventName)
+}
+
+func TestInboundDisconnect(t *testing.T) {
+	config := *DefaultConnectionConfig
+	config.InboundQueueSize = 1
+	config.InboundPolicy = QueueDisconnect
+	client, server, cleanup := setupPair(t, nil, &config)
+	defer cleanup()
+
+	client.Write(&SkataEvent{EventName: "a"})
+	client.Write(&SkataEvent{EventName: "b"})
+	select {
+	case <-server.Done():
+		assert.Equal(t, ErrQueueFull, server.Err())
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestInboundDisconnectStalledPeer(t *testing.T) {
+	// a client whose unbuffered pipe nobody reads stops reading
+	// the connection, the server must still give up on it
+	dialConfig := *DefaultConnectionConfig
+	dialConfig.InboundQueueSize = 0
+	config := *DefaultConnectionConfig
+	config.InboundQueueSize = 0
+	config.InboundPolicy = QueueDisconnect
+	client, server, cleanup := setupPair(t, &dialConfig, &config)
+	defer cleanup()
+
+	assert.NoError(t, server.Write(&SkataEvent{EventName: "stall"}))
+	assert.NoError(t, client.Write(&SkataEvent{EventName: "overflow"}))
+	select {
+	case <-server.Done():
+		assert.Equal(t, ErrQueueFull, server.Err())
+	case <-time.After(lastWordsTimeout * 3):
+		t.Fatal("read loop hung on the stalled peer")
+	}
+}
+
+func TestOutboundDropNewest(t *testing.T) {
+	// an unbuffered client pipe nobody reads stalls the server writer
+	dialConfig := *DefaultConnectionConfig
+	dialConfig.InboundQueueSize = 0
+	config := *DefaultConnectionConfig
+	config.OutboundQueueSize = 2
+	config.OutboundPolicy = QueueDropNewest
+	_, server, cleanup := setupPair(t, &dialConfig, &config)
+	defer cleanup()
+
+	var failed uint64
+	for i := 0; i < 10; i++ {
+		if err := server.Write(&SkataEvent{EventName: "tick"}); err != nil {
+			assert.Equal(t, ErrQueueFull, err)
+			failed++
+		}
+	}
+	stats := server.Stats()
+	assert.NotZero(t, failed)
+	assert.Equal(t, failed, stats.OutboundDropped)
+	assert.True(t, stats.OutboundDepth <= 2)
+}
+
+func TestDropOldestSparesStreams(t *testing.T) {
+	config := *DefaultConnectionConfig
+	config.OutboundQueueSize = 1
+	config.OutboundPolicy = QueueDropOldest
+	client, server, cleanup := setupPair(t, &config, &config)
+	defer cleanup()
+	go func() {
+		for range server.Pipe {
+		}
+	}()
+
+	// custom messages compete with the stream for the bulk lane
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				client.Write(&SkataCustom{Data: []byte("noise")})
+			}
+		}
+	}()
+	payload := bytes.Repeat([]byte("skata"), 128<<10/5)
+	go func() {
+		stream, err := client.OpenStream()
+		if err != nil {
+			return
+		}
+		stream.Write(payload)
+		stream.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	stream, err := server.AcceptStream(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	received := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(stream)
+		received <- data
+	}()
+	select {
+	case data := <-received:
+		assert.Equal(t, payload, data)
+	case <-ctx.Done():
+		t.Fatal("stream data was dropped")
+	}
+}
+
+func TestWriteControlNeverBlocks(t *testing.T) {
+	// a connection without writer whose lanes hold a single frame
+	c := new(Connection)
+	c.config = DefaultConnectionConfig
+	c.closing = make(chan struct{})
+	for i := range c.outbound {
+		c.outbound[i] = make(chan outboundFrame, 1)
+	}
+	assert.True(t, c.writeControl(&SkataStreamFrame{StreamID: 1, Op: StreamWindow, Increment: 5}))
+	assert.False(t, c.writeControl(&SkataStreamFrame{StreamID: 1, Op: StreamWindow, Increment: 5}))
+	assert.Equal(t, uint64(1), c.Stats().OutboundDropped)
+
+	close(c.closing)
+	assert.False(t, c.writeControl(&SkataSignal{Signal: Pong}))
+}
@@ -0,0 +1,279 @@
+package comms
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"skata/common"
+	"sync"
+	"time"
+)
+
+// ErrBufferFull is returned by ReconnectingConnection.Write when the
+// link is down and the outbound buffer has reached its limit
+var ErrBufferFull = errors.New("comms: outbound buffer full")
+
+// ConnectionState describes where a ReconnectingConnection
+// is in its lifecycle
+type ConnectionState uint8
+
+// Connection states
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateReconnecting
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// ReconnectConfig controls how a ReconnectingConnection redials
+type ReconnectConfig struct {
+	// Dialer is used for every attempt. If nil the default dialer is used.
+	Dialer *Dialer
+	// InitialBackoff is the wait after the first failed attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps the exponentially growing wait, jitter included
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after every failed attempt
+	Multiplier float64
+	// Jitter randomizes every wait by up to this fraction in either direction
+	Jitter float64
+	// MaxBuffered is the number of messages held while disconnected
+	MaxBuffered int
+}
+
+// DefaultReconnectConfig is the default reconnect setting
+var DefaultReconnectConfig = &ReconnectConfig{
+	InitialBackoff: time.Millisecond * 100,
+	MaxBackoff:     time.Second * 30,
+	Multiplier:     2,
+	Jitter:         0.2,
+	MaxBuffered:    1024,
+}
+
+// ReconnectingConnection keeps a Connection to a listener alive,
+// redialing with the same Source whenever the link drops. Messages
+// from every underlying connection are delivered on Pipe and state
+// changes are published on StateChan.
+//
+// Delivery is at most once. Only messages written while the link is
+// down are buffered; messages already queued on a connection when it
+// drops are lost without notice.
+type ReconnectingConnection struct {
+	Source    common.SkataNodeID
+	Pipe      chan SkataMessage
+	StateChan <-chan ConnectionState
+
+	addr      string
+	config    *ReconnectConfig
+	dialer    *Dialer
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stateChan chan ConnectionState
+	lock      sync.Mutex
+	conn      *Connection
+	state     ConnectionState
+	buffer    []SkataMessage
+	// flushing is set while the buffer is written to a new conn
+	flushing bool
+}
+
+// NewReconnectingConnection starts connecting to addr in the background
+// and returns immediately. Writes made before the first connection is
+// established are buffered. If config is nil DefaultReconnectConfig is used.
+func NewReconnectingConnection(addr string, source common.SkataNodeID, config *ReconnectConfig) *ReconnectingConnection {
+	if config == nil {
+		config = DefaultReconnectConfig
+	}
+	r := new(ReconnectingConnection)
+	r.Source = source
+	r.Pipe = make(chan SkataMessage)
+	r.stateChan = make(chan ConnectionState, 16)
+	r.StateChan = r.stateChan
+	r.addr = addr
+	r.config = config
+	r.dialer = config.Dialer
+	if r.dialer == nil {
+		r.dialer = new(Dialer)
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	go r.run()
+	return r
+}
+
+// State returns the current state of the connection
+func (r *ReconnectingConnection) State() ConnectionState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state
+}
+
+// setState must be called with the lock held. If nobody keeps up
+// with StateChan the oldest notifications are dropped, so the last
+// one received is always the current state.
+func (r *ReconnectingConnection) setState(state ConnectionState) {
+	r.state = state
+	for {
+		select {
+		case r.stateChan <- state:
+			return
+		default:
+		}
+		select {
+		case <-r.stateChan:
+		default:
+		}
+	}
+}
+
+// Write sends the message on the current connection, or buffers it
+// until the link is back up
+func (r *ReconnectingConnection) Write(msg SkataMessage) error {
+	var failed *Connection
+	for {
+		r.lock.Lock()
+		if r.state == StateClosed {
+			r.lock.Unlock()
+			return ErrConnectionClosed
+		}
+		conn := r.conn
+		if conn == nil || conn == failed || r.flushing {
+			defer r.lock.Unlock()
+			if len(r.buffer) >= r.config.MaxBuffered {
+				return ErrBufferFull
+			}
+			r.buffer = append(r.buffer, msg)
+			return nil
+		}
+		r.lock.Unlock()
+		// the write may wait for room in the outbound queue, which
+		// must not hold up Close and State
+		if conn.Write(msg) == nil {
+			return nil
+		}
+		failed = conn
+	}
+}
+
+// Close stops reconnecting and closes the current connection
+func (r *ReconnectingConnection) Close() error {
+	r.cancel()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	return nil
+}
+
+// backoff returns the jittered wait for the given base duration,
+// capped at MaxBackoff
+func (r *ReconnectingConnection) backoff(base time.Duration) time.Duration {
+	jitter := r.config.Jitter * (2*rand.Float64() - 1)
+	wait := time.Duration(float64(base) * (1 + jitter))
+	if wait > r.config.MaxBackoff {
+		wait = r.config.MaxBackoff
+	}
+	return wait
+}
+
+// connected writes the buffered messages to conn and makes it the
+// current connection. The lock is released while writing, so Close
+// can still reach conn; Writes keep buffering meanwhile so that
+// they stay behind the earlier messages.
+func (r *ReconnectingConnection) connected(conn *Connection) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.ctx.Err() != nil {
+		// Close raced with the dial
+		conn.Close()
+		return
+	}
+	r.conn = conn
+	r.flushing = true
+	for len(r.buffer) > 0 {
+		pending := r.buffer
+		r.buffer = nil
+		r.lock.Unlock()
+		sent := 0
+		for _, msg := range pending {
+			if conn.Write(msg) != nil {
+				break
+			}
+			sent++
+		}
+		r.lock.Lock()
+		if sent < len(pending) {
+			// the link dropped already, keep the rest for the next one
+			r.buffer = append(pending[sent:], r.buffer...)
+			break
+		}
+	}
+	r.flushing = false
+	r.setState(StateConnected)
+}
+
+func (r *ReconnectingConnection) disconnected() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.conn = nil
+	if r.ctx.Err() == nil {
+		r.setState(StateReconnecting)
+	}
+}
+
+func (r *ReconnectingConnection) run() {
+	defer func() {
+		r.lock.Lock()
+		r.setState(StateClosed)
+		r.lock.Unlock()
+		close(r.Pipe)
+	}()
+	wait := r.config.InitialBackoff
+	for r.ctx.Err() == nil {
+		conn, err := r.dialer.DialContext(r.ctx, r.addr, r.Source)
+		if err != nil {
+			timer := time.NewTimer(r.backoff(wait))
+			select {
+			case <-timer.C:
+			case <-r.ctx.Done():
+				timer.Stop()
+				return
+			}
+			wait = time.Duration(float64(wait) * r.config.Multiplier)
+			if wait > r.config.MaxBackoff {
+				wait = r.config.MaxBackoff
+			}
+			continue
+		}
+		wait = r.config.InitialBackoff
+		r.connected(conn)
+		r.forward(conn)
+		r.disconnected()
+	}
+}
+
+// forward hands messages from conn to Pipe until conn dies
+func (r *ReconnectingConnection) forward(conn *Connection) {
+	for msg := range conn.Pipe {
+		select {
+		case r.Pipe <- msg:
+		case <-r.ctx.Done():
+			conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package comms
+
+import (
+	"net"
+	"skata/common"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testReconnectConfig = &ReconnectConfig{
+	InitialBackoff: time.Millisecond * 10,
+	MaxBackoff:     time.Millisecond * 50,
+	Multiplier:     2,
+	Jitter:         0.2,
+	MaxBuffered:    1,
+}
+
+func awaitState(t *testing.T, conn *ReconnectingConnection, expected ConnectionState) {
+	timeout := time.After(time.Second * 2)
+	for {
+		select {
+		case state := <-conn.StateChan:
+			if state == expected {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("never reached state %s", expected)
+		}
+	}
+}
+
+func TestReconnectingConnectionBuffers(t *testing.T) {
+	// reserve an address nothing listens on yet
+	tcpListener, _ := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	addr := tcpListener.Addr().String()
+	tcpListener.Close()
+
+	source := common.GenerateID(common.WorkerNode)
+	client := NewReconnectingConnection(addr, source, testReconnectConfig)
+	defer client.Close()
+
+	custom := new(SkataCustom)
+	custom.Data = []byte("test")
+	assert.NoError(t, client.Write(custom))
+	assert.Equal(t, ErrBufferFull, client.Write(custom))
+
+	listener, err := NewListener(addr, nil)
+	assert.NoError(t, err)
+	defer listener.Close()
+	server := <-listener.ConnectionChan
+	assert.Equal(t, source, server.Source)
+	assert.Equal(t, custom.Data, (<-server.Pipe).(*SkataCustom).Data)
+	awaitState(t, client, StateConnected)
+}
+
+func TestReconnectingConnectionRedials(t *testing.T) {
+	listener, err := NewListener("127.0.0.1:0", nil)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	source := common.GenerateID(common.WorkerNode)
+	client := NewReconnectingConnection(listener.Addr().String(), source, testReconnectConfig)
+	server := <-listener.ConnectionChan
+	awaitState(t, client, StateConnected)
+
+	server.Close()
+	awaitState(t, client, StateReconnecting)
+	server = <-listener.ConnectionChan
+	assert.Equal(t, source, server.Source)
+	awaitState(t, client, StateConnected)
+
+	client.Close()
+	awaitState(t, client, StateClosed)
+	_, open := <-client.Pipe
+	assert.False(t, open)
+}
+
+func TestReconnectBackoffCap(t *testing.T) {
+	r := &ReconnectingConnection{config: &ReconnectConfig{MaxBackoff: time.Second, Jitter: 0.5}}
+	for i := 0; i < 100; i++ {
+		assert.True(t, r.backoff(time.Second) <= time.Second)
+	}
+}
+
+func TestReconnectStateKeepsLatest(t *testing.T) {
+	r := &ReconnectingConnection{stateChan: make(chan ConnectionState, 2)}
+	r.setState(StateConnecting)
+	r.setState(StateConnected)
+	r.setState(StateReconnecting)
+	r.setState(StateClosed)
+	assert.Equal(t, StateReconnecting, <-r.stateChan)
+	assert.Equal(t, StateClosed, <-r.stateChan)
+}
@@ -0,0 +1,90 @@
+package comms
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Type bytes below UserMessageTypeStart are reserved for the
+// built-in skata messages. Applications are free to register
+// their own message types from UserMessageTypeStart up to
+// MaxMessageType.
+const (
+	UserMessageTypeStart SkataMessageType = 0x80
+	MaxMessageType       SkataMessageType = 0xFF
+)
+
+// Registry errors
+var (
+	ErrEmptyPacket          = errors.New("comms: empty packet")
+	ErrUnknownMessageType   = errors.New("comms: unknown message type")
+	ErrReservedMessageType  = errors.New("comms: message type is reserved")
+	ErrDuplicateMessageType = errors.New("comms: message type already registered")
+)
+
+// MessageFactory creates an empty message ready to be deserialized into
+type MessageFactory func() SkataMessage
+
+var (
+	registryLock    sync.RWMutex
+	messageRegistry = map[SkataMessageType]MessageFactory{}
+)
+
+func init() {
+	registerMessageType(Event, func() SkataMessage { return new(SkataEvent) })
+	registerMessageType(Signal, func() SkataMessage { return new(SkataSignal) })
+	registerMessageType(Request, func() SkataMessage { return new(SkataRequest) })
+	registerMessageType(Response, func() SkataMessage { return new(SkataResponse) })
+	registerMessageType(Custom, func() SkataMessage { return new(SkataCustom) })
+	registerMessageType(Handshake, func() SkataMessage { return new(SkataHandshake) })
+	registerMessageType(Error, func() SkataMessage { return new(SkataError) })
+	registerMessageType(StreamFrame, func() SkataMessage { return new(SkataStreamFrame) })
+	registerMessageType(Challenge, func() SkataMessage { return new(SkataChallenge) })
+	registerMessageType(Authenticate, func() SkataMessage { return new(SkataAuthenticate) })
+}
+
+func registerMessageType(messageType SkataMessageType, factory MessageFactory) error {
+	if messageType > MaxMessageType {
+		return fmt.Errorf("comms: message type %d does not fit in a type byte", messageType)
+	}
+	if factory == nil {
+		return errors.New("comms: nil message factory")
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, found := messageRegistry[messageType]; found {
+		return ErrDuplicateMessageType
+	}
+	messageRegistry[messageType] = factory
+	return nil
+}
+
+// unregisterMessageType forgets a registered type, so tests can
+// register their types again on every run
+func unregisterMessageType(messageType SkataMessageType) {
+	registryLock.Lock()
+	delete(messageRegistry, messageType)
+	registryLock.Unlock()
+}
+
+// RegisterMessageType registers a factory for a user defined message
+// type so that it can be decoded off the wire. The type must lie in
+// the user range starting at UserMessageTypeStart.
+func RegisterMessageType(messageType SkataMessageType, factory MessageFactory) error {
+	if messageType < UserMessageTypeStart {
+		return ErrReservedMessageType
+	}
+	return registerMessageType(messageType, factory)
+}
+
+// NewMessage returns an empty message for the given type
+func NewMessage(messageType SkataMessageType) (SkataMessage, error) {
+	registryLock.RLock()
+	factory, found := messageRegistry[messageType]
+	registryLock.RUnlock()
+	if !found {
+		return nil, ErrUnknownMessageType
+	}
+	return factory(), nil
+}
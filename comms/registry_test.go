@@ -0,0 +1,91 @@
+package comms
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testUserMessage struct {
+	SkataMessageBase
+	Payload string
+}
+
+const testUserMessageType = UserMessageTypeStart + 1
+
+func (m testUserMessage) Type() SkataMessageType {
+	return testUserMessageType
+}
+
+func (m *testUserMessage) Serialize() []byte {
+	return []byte(m.Payload)
+}
+
+func (m *testUserMessage) Deserialize(data []byte) error {
+	m.Payload = string(data)
+	return nil
+}
+
+func TestRegisterMessageType(t *testing.T) {
+	err := RegisterMessageType(testUserMessageType, func() SkataMessage { return new(testUserMessage) })
+	assert.NoError(t, err)
+	t.Cleanup(func() { unregisterMessageType(testUserMessageType) })
+
+	message := &testUserMessage{Payload: "test"}
+	decoded, err := parsePacket(createPacket(message))
+	assert.NoError(t, err)
+	assert.Equal(t, message, decoded)
+
+	err = RegisterMessageType(testUserMessageType, func() SkataMessage { return new(testUserMessage) })
+	assert.Equal(t, ErrDuplicateMessageType, err)
+}
+
+// retainingMessage keeps the data it is given, which the message
+// interface allows
+type retainingMessage struct {
+	SkataMessageBase
+	Data []byte
+}
+
+const retainingMessageType = UserMessageTypeStart + 2
+
+func (m retainingMessage) Type() SkataMessageType {
+	return retainingMessageType
+}
+
+func (m *retainingMessage) Serialize() []byte {
+	return m.Data
+}
+
+func (m *retainingMessage) Deserialize(data []byte) error {
+	m.Data = data
+	return nil
+}
+
+func TestRegisteredMessageKeepsData(t *testing.T) {
+	err := RegisterMessageType(retainingMessageType, func() SkataMessage { return new(retainingMessage) })
+	assert.NoError(t, err)
+	t.Cleanup(func() { unregisterMessageType(retainingMessageType) })
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+
+	assert.NoError(t, client.Write(&retainingMessage{Data: []byte("first")}))
+	first := (<-server.Pipe).(*retainingMessage)
+	assert.NoError(t, client.Write(&retainingMessage{Data: []byte("later")}))
+	second := (<-server.Pipe).(*retainingMessage)
+	assert.Equal(t, []byte("first"), first.Data)
+	assert.Equal(t, []byte("later"), second.Data)
+}
+
+func TestRegisterReservedMessageType(t *testing.T) {
+	err := RegisterMessageType(Signal, func() SkataMessage { return new(SkataSignal) })
+	assert.Equal(t, ErrReservedMessageType, err)
+
+	err = RegisterMessageType(MaxMessageType+1, func() SkataMessage { return new(SkataSignal) })
+	assert.Error(t, err)
+
+	// built-in types are always available
+	msg, err := NewMessage(Signal)
+	assert.NoError(t, err)
+	assert.IsType(t, new(SkataSignal), msg)
+}
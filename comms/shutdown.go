@@ -0,0 +1,160 @@
+package comms
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ShutdownTimeout bounds the shutdown a connection goes through
+// when the peer says Goodbye
+const ShutdownTimeout = time.Second * 5
+
+// DrainTimeout bounds the shutdown Serve starts once a drain
+// requested by the peer is done
+const DrainTimeout = time.Second * 5
+
+// ErrDrainUnsupported is returned when the peer can't be drained
+var ErrDrainUnsupported = errors.New("comms: peer does not support draining")
+
+// Drain asks the peer to finish its work and shut the connection
+// down. Peers served by Serve do so once their running handlers
+// are done.
+func (c *Connection) Drain() error {
+	if !c.Features().Has(FeatureDrain) {
+		return ErrDrainUnsupported
+	}
+	return c.Write(&SkataSignal{Signal: Drain})
+}
+
+// Draining returns a channel that is closed once the peer asked
+// this side to drain
+func (c *Connection) Draining() <-chan struct{} {
+	return c.draining
+}
+
+// Shutdown closes the connection gracefully. Writes made before
+// the call are still sent, then the peer is told Goodbye and
+// Shutdown waits for the peer's Goodbye before closing. If ctx is
+// done first the connection is closed right away and the context's
+// error is returned. Writes made after the call fail.
+func (c *Connection) Shutdown(ctx context.Context) error {
+	c.leaveOnce.Do(func() {
+		close(c.leaving)
+		var frame outboundFrame
+		if c.Features().Has(FeatureDrain) {
+			frame = c.encode(&SkataSignal{Signal: Goodbye})
+		}
+		frame.sent = c.goodbyeSent
+		c.pin(&frame, PriorityBulk)
+		// bulk frames go last, so the Goodbye follows everything
+		// queued before it
+		select {
+		case c.outbound[PriorityBulk] <- frame:
+		case <-c.closing:
+			frame.release()
+		case <-ctx.Done():
+			frame.release()
+		}
+	})
+	select {
+	case <-c.goodbyeSent:
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+	if c.Features().Has(FeatureDrain) {
+		select {
+		case <-c.goodbyeReceived:
+		case <-c.done:
+			return nil
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+	c.Close()
+	return nil
+}
+
+// saidGoodbye reports whether the peer said Goodbye
+func (c *Connection) saidGoodbye() bool {
+	select {
+	case <-c.goodbyeReceived:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleShutdownSignal takes Drain and Goodbye signals off the
+// read loop. A Goodbye is answered by shutting down this side too.
+func (c *Connection) handleShutdownSignal(msg SkataMessage) bool {
+	signal, ok := msg.(*SkataSignal)
+	if !ok {
+		return false
+	}
+	switch signal.Signal {
+	case Drain:
+		c.drainOnce.Do(func() { close(c.draining) })
+	case Goodbye:
+		c.goodbyeOnce.Do(func() {
+			close(c.goodbyeReceived)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+				defer cancel()
+				c.Shutdown(ctx)
+			}()
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// track remembers an accepted connection until it ends
+func (l *Listener) track(conn *Connection) {
+	l.connLock.Lock()
+	l.connections[conn] = struct{}{}
+	l.connLock.Unlock()
+	go func() {
+		<-conn.Done()
+		l.connLock.Lock()
+		delete(l.connections, conn)
+		l.connLock.Unlock()
+	}()
+}
+
+// Shutdown stops accepting connections and drains the accepted
+// ones. Peers that support it are asked to finish their work and
+// say Goodbye, the others are shut down right away. Shutdown waits
+// for every connection to end or for ctx to be done, in which case
+// the remaining connections are closed and the context's error is
+// returned.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	err := l.Close()
+	l.connLock.Lock()
+	connections := make([]*Connection, 0, len(l.connections))
+	for conn := range l.connections {
+		connections = append(connections, conn)
+	}
+	l.connLock.Unlock()
+	for _, conn := range connections {
+		if conn.Drain() != nil {
+			go conn.Shutdown(ctx)
+		}
+	}
+	for _, conn := range connections {
+		select {
+		case <-conn.Done():
+		case <-ctx.Done():
+			for _, conn := range connections {
+				conn.Close()
+			}
+			return ctx.Err()
+		}
+	}
+	return err
+}
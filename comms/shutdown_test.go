@@ -0,0 +1,105 @@
+package comms
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"skata/common"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionShutdownFlushes(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+
+	names := []string{"a", "b", "c", "d"}
+	for _, name := range names {
+		assert.NoError(t, client.Write(&SkataEvent{EventName: name}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, client.Shutdown(ctx))
+	assert.Equal(t, ErrConnectionClosed, client.Write(&SkataEvent{EventName: "late"}))
+
+	var received []string
+	for msg := range server.Pipe {
+		received = append(received, msg.(*SkataEvent).EventName)
+	}
+	assert.Equal(t, names, received)
+	assert.True(t, server.saidGoodbye())
+}
+
+func TestListenerShutdown(t *testing.T) {
+	config := *DefaultConnectionConfig
+	config.Transport = NewMemoryTransport()
+	config.Logger = log.New(ioutil.Discard, "", 0)
+	listener, err := NewListener("hub", &config)
+	assert.NoError(t, err)
+	dialer := &Dialer{Config: &config}
+	client, err := dialer.DialContext(context.Background(), "hub", common.GenerateID(common.WorkerNode))
+	assert.NoError(t, err)
+	server := <-listener.ConnectionChan
+
+	finished := make(chan struct{})
+	handler := new(MessageHandler)
+	handler.EventHandlers = map[string]EventHandler{"job": func(*SkataEvent) error {
+		time.Sleep(time.Millisecond * 20)
+		close(finished)
+		return nil
+	}}
+	served := make(chan error)
+	go func() {
+		served <- client.Serve(context.Background(), handler)
+	}()
+	assert.NoError(t, server.Write(&SkataEvent{EventName: "job"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, listener.Shutdown(ctx))
+	// the node finished its work before leaving
+	select {
+	case <-finished:
+	default:
+		t.Fatal("handler did not finish before shutdown")
+	}
+	assert.NoError(t, <-served)
+	_, err = dialer.DialContext(context.Background(), "hub", common.GenerateID(common.WorkerNode))
+	assert.Equal(t, ErrNoListener, err)
+}
+
+func TestListenerShutdownTimeout(t *testing.T) {
+	config := *DefaultConnectionConfig
+	config.Logger = log.New(ioutil.Discard, "", 0)
+	listener, err := NewListener("127.0.0.1:0", &config)
+	assert.NoError(t, err)
+	client, err := DialContext(context.Background(), listener.Addr().String(), common.GenerateID(common.WorkerNode))
+	assert.NoError(t, err)
+	server := <-listener.ConnectionChan
+
+	// the client never serves the drain request
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, listener.Shutdown(ctx))
+	<-server.Done()
+	<-client.Done()
+}
+
+func TestListenAndAcceptStopsWhenClosed(t *testing.T) {
+	listener, err := NewListener("127.0.0.1:0", nil)
+	assert.NoError(t, err)
+	listener.Close()
+
+	returned := make(chan struct{})
+	go func() {
+		listener.ListenAndAccept()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndAccept kept running after Close")
+	}
+}
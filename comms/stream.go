@@ -0,0 +1,284 @@
+package comms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// MaxStreamChunk is the largest amount of stream data sent in a
+// single frame, so that other messages can be interleaved between
+// the chunks of a large transfer
+const MaxStreamChunk = 16 << 10
+
+// streamAcceptBacklog is the number of opened streams that
+// can wait for AcceptStream before new ones get reset
+const streamAcceptBacklog = 16
+
+// Stream errors
+var (
+	ErrStreamsUnsupported = errors.New("comms: peer does not support streams")
+	ErrStreamClosed       = errors.New("comms: write on closed stream")
+	ErrStreamReset        = errors.New("comms: stream reset")
+)
+
+// Stream is a lightweight ordered byte stream multiplexed over a
+// Connection. Each direction is flow controlled independently so
+// a slow reader only ever stalls its own stream.
+type Stream struct {
+	ID   uint32
+	conn *Connection
+
+	lock         sync.Mutex
+	cond         *sync.Cond
+	readBuffer   bytes.Buffer
+	recvWindow   uint32
+	sendWindow   uint32
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newStream(conn *Connection, id uint32) *Stream {
+	stream := new(Stream)
+	stream.ID = id
+	stream.conn = conn
+	stream.cond = sync.NewCond(&stream.lock)
+	stream.recvWindow = conn.config.streamWindow()
+	return stream
+}
+
+func (s *Stream) frame(op StreamOp, increment uint32, data []byte) *SkataStreamFrame {
+	frame := new(SkataStreamFrame)
+	frame.StreamID = s.ID
+	frame.Op = op
+	frame.Increment = increment
+	frame.Data = data
+	return frame
+}
+
+// Read reads stream data. It returns io.EOF once the peer has
+// closed its side and all its data has been read.
+func (s *Stream) Read(p []byte) (n int, err error) {
+	s.lock.Lock()
+	for s.readBuffer.Len() == 0 && !s.remoteClosed && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.readBuffer.Len() == 0 {
+		err = s.err
+		if err == nil {
+			err = io.EOF
+		}
+		s.lock.Unlock()
+		return
+	}
+	n, _ = s.readBuffer.Read(p)
+	s.recvWindow += uint32(n)
+	s.lock.Unlock()
+	// hand the consumed space back to the sender
+	s.conn.Write(s.frame(StreamWindow, uint32(n), nil))
+	return
+}
+
+// Write sends p in chunks of at most MaxStreamChunk, blocking
+// while the peer's receive window is exhausted
+func (s *Stream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		s.lock.Lock()
+		for s.sendWindow == 0 && !s.localClosed && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil || s.localClosed {
+			err = s.err
+			if err == nil {
+				err = ErrStreamClosed
+			}
+			s.lock.Unlock()
+			return
+		}
+		chunk := len(p)
+		if chunk > MaxStreamChunk {
+			chunk = MaxStreamChunk
+		}
+		if uint32(chunk) > s.sendWindow {
+			chunk = int(s.sendWindow)
+		}
+		s.sendWindow -= uint32(chunk)
+		s.lock.Unlock()
+		if err = s.conn.Write(s.frame(StreamData, 0, p[:chunk])); err != nil {
+			return
+		}
+		n += chunk
+		p = p[chunk:]
+	}
+	return
+}
+
+// Close ends the local side of the stream. The peer can keep
+// sending until it closes its own side.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	if s.localClosed || s.err != nil {
+		s.lock.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	finished := s.remoteClosed
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	if finished {
+		s.conn.forgetStream(s.ID)
+	}
+	return s.conn.Write(s.frame(StreamClose, 0, nil))
+}
+
+// Reset aborts the stream in both directions
+func (s *Stream) Reset() error {
+	s.fail(ErrStreamReset)
+	return s.conn.Write(s.frame(StreamReset, 0, nil))
+}
+
+// abort resets the stream from the read loop without blocking
+func (s *Stream) abort() {
+	s.fail(ErrStreamReset)
+	s.conn.writeControl(s.frame(StreamReset, 0, nil))
+}
+
+// fail ends the stream with err and wakes up every blocked call
+func (s *Stream) fail(err error) {
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	s.conn.forgetStream(s.ID)
+}
+
+// OpenStream opens a new stream to the peer
+func (c *Connection) OpenStream() (*Stream, error) {
+	if !c.Features().Has(FeatureStreams) {
+		return nil, ErrStreamsUnsupported
+	}
+	// dialers use odd IDs and listeners even ones so both
+	// sides can open streams without colliding
+	id := uint32(atomic.AddUint32(&c.streamSeq, 1))*2 - 1
+	if c.server {
+		id++
+	}
+	stream := newStream(c, id)
+	c.streamLock.Lock()
+	if c.streams == nil {
+		c.streams = make(map[uint32]*Stream)
+	}
+	c.streams[id] = stream
+	c.streamLock.Unlock()
+	if err := c.Write(stream.frame(StreamOpen, stream.recvWindow, nil)); err != nil {
+		c.forgetStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream waits for the peer to open a stream
+func (c *Connection) AcceptStream(ctx context.Context) (*Stream, error) {
+	if !c.Features().Has(FeatureStreams) {
+		return nil, ErrStreamsUnsupported
+	}
+	select {
+	case stream := <-c.acceptedStreams:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+func (c *Connection) forgetStream(id uint32) {
+	c.streamLock.Lock()
+	delete(c.streams, id)
+	c.streamLock.Unlock()
+}
+
+// handleStreamFrame is called from the read loop for every stream
+// frame and must never block, neither on the application nor on a
+// full outbound queue. Streams whose replies can't be queued are
+// reset.
+func (c *Connection) handleStreamFrame(frame *SkataStreamFrame) {
+	c.streamLock.Lock()
+	stream, found := c.streams[frame.StreamID]
+	c.streamLock.Unlock()
+
+	if frame.Op == StreamOpen {
+		if found {
+			return
+		}
+		stream = newStream(c, frame.StreamID)
+		stream.sendWindow = frame.Increment
+		c.streamLock.Lock()
+		if c.streams == nil {
+			c.streams = make(map[uint32]*Stream)
+		}
+		c.streams[frame.StreamID] = stream
+		c.streamLock.Unlock()
+		select {
+		case c.acceptedStreams <- stream:
+			if !c.writeControl(stream.frame(StreamWindow, stream.recvWindow, nil)) {
+				stream.abort()
+			}
+		default:
+			stream.abort()
+		}
+		return
+	}
+	if !found {
+		return
+	}
+
+	stream.lock.Lock()
+	switch frame.Op {
+	case StreamData:
+		if uint32(len(frame.Data)) > stream.recvWindow {
+			// the peer ignored flow control
+			stream.lock.Unlock()
+			stream.abort()
+			return
+		}
+		stream.recvWindow -= uint32(len(frame.Data))
+		stream.readBuffer.Write(frame.Data)
+	case StreamWindow:
+		stream.sendWindow += frame.Increment
+	case StreamClose:
+		stream.remoteClosed = true
+		if stream.localClosed {
+			c.forgetStream(stream.ID)
+		}
+	case StreamReset:
+		if stream.err == nil {
+			stream.err = ErrStreamReset
+		}
+		c.forgetStream(stream.ID)
+	}
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+}
+
+// closeStreams fails every open stream once the connection is gone
+func (c *Connection) closeStreams(err error) {
+	c.streamLock.Lock()
+	streams := c.streams
+	c.streams = nil
+	c.streamLock.Unlock()
+	for _, stream := range streams {
+		stream.lock.Lock()
+		if stream.err == nil {
+			stream.err = err
+		}
+		stream.cond.Broadcast()
+		stream.lock.Unlock()
+	}
+}
@@ -0,0 +1,99 @@
+package comms
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"skata/common"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamTransfer(t *testing.T) {
+	config := &ConnectionConfig{MaxFrameSize: 1 << 20, StreamWindow: 4096}
+	listener, err := NewListener("127.0.0.1:0", config)
+	assert.NoError(t, err)
+	defer listener.Close()
+	dialer := &Dialer{Config: config}
+	client, err := dialer.DialContext(context.Background(), listener.Addr().String(), common.GenerateID(common.WorkerNode))
+	assert.NoError(t, err)
+	defer client.Close()
+	server := <-listener.ConnectionChan
+	defer server.Close()
+
+	payload := bytes.Repeat([]byte("skata"), 200000)
+	go func() {
+		stream, err := client.OpenStream()
+		if err != nil {
+			return
+		}
+		stream.Write(payload)
+		stream.Close()
+	}()
+
+	stream, err := server.AcceptStream(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), stream.ID%2)
+
+	// control traffic keeps flowing while the stream is busy
+	go func() {
+		request := (<-client.Pipe).(*SkataRequest)
+		client.Write(&SkataResponse{RequestID: request.ID})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = server.Call(ctx, &SkataRequest{Request: Status})
+	assert.NoError(t, err)
+
+	received, err := io.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, received)
+	stream.Close()
+}
+
+func TestStreamZeroConfig(t *testing.T) {
+	// zero limits fall back to the defaults instead of refusing
+	// every frame and never opening the stream window
+	config := &ConnectionConfig{}
+	listener, err := NewListener("127.0.0.1:0", config)
+	assert.NoError(t, err)
+	defer listener.Close()
+	dialer := &Dialer{Config: config}
+	client, err := dialer.DialContext(context.Background(), listener.Addr().String(), common.GenerateID(common.WorkerNode))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	server := <-listener.ConnectionChan
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	assert.NoError(t, err)
+	_, err = stream.Write([]byte("skata"))
+	assert.NoError(t, err)
+	stream.Close()
+	accepted, err := server.AcceptStream(context.Background())
+	assert.NoError(t, err)
+	received, err := io.ReadAll(accepted)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("skata"), received)
+}
+
+func TestStreamConnectionClose(t *testing.T) {
+	client, server, cleanup := setupPair(t, nil, nil)
+	defer cleanup()
+
+	stream, err := client.OpenStream()
+	assert.NoError(t, err)
+	accepted, err := server.AcceptStream(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, stream.ID, accepted.ID)
+
+	server.Close()
+	_, err = accepted.Read(make([]byte, 1))
+	assert.Equal(t, ErrConnectionClosed, err)
+	_, err = stream.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,107 @@
+package comms
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalidPattern is returned for malformed event name patterns
+var ErrInvalidPattern = errors.New("comms: invalid event pattern")
+
+// eventTrie matches dotted event names against patterns. Each
+// level holds one token of the patterns registered below it.
+type eventTrie struct {
+	handler  EventHandler
+	children map[string]*eventTrie
+	wildcard *eventTrie
+	tail     EventHandler
+}
+
+func (t *eventTrie) insert(tokens []string, handler EventHandler) {
+	if len(tokens) == 0 {
+		t.handler = handler
+		return
+	}
+	switch tokens[0] {
+	case ">":
+		t.tail = handler
+		return
+	case "*":
+		if t.wildcard == nil {
+			t.wildcard = new(eventTrie)
+		}
+		t.wildcard.insert(tokens[1:], handler)
+		return
+	}
+	if t.children == nil {
+		t.children = make(map[string]*eventTrie)
+	}
+	child, found := t.children[tokens[0]]
+	if !found {
+		child = new(eventTrie)
+		t.children[tokens[0]] = child
+	}
+	child.insert(tokens[1:], handler)
+}
+
+// match returns the handler of the most specific pattern matching
+// the tokens. At every level a literal token beats "*" which beats
+// ">", so the first token where two patterns differ decides.
+func (t *eventTrie) match(tokens []string) EventHandler {
+	if len(tokens) == 0 {
+		return t.handler
+	}
+	if child, found := t.children[tokens[0]]; found {
+		if handler := child.match(tokens[1:]); handler != nil {
+			return handler
+		}
+	}
+	if t.wildcard != nil {
+		if handler := t.wildcard.match(tokens[1:]); handler != nil {
+			return handler
+		}
+	}
+	return t.tail
+}
+
+func parsePattern(pattern string) ([]string, error) {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		if token == "" || (token == ">" && i != len(tokens)-1) {
+			return nil, ErrInvalidPattern
+		}
+		if token != "*" && token != ">" && strings.ContainsAny(token, "*>") {
+			return nil, ErrInvalidPattern
+		}
+	}
+	return tokens, nil
+}
+
+// HandleEvent registers an event handler for a dotted name pattern.
+// A "*" token matches exactly one token and a trailing ">" matches
+// one or more tokens, so "job.*.failed" matches "job.backup.failed"
+// and "job.>" matches every job event. Exact names registered in
+// EventHandlers take precedence over patterns. Like the handler maps,
+// patterns must be registered before the handler is served.
+func (m *MessageHandler) HandleEvent(pattern string, handler EventHandler) error {
+	tokens, err := parsePattern(pattern)
+	if err != nil {
+		return err
+	}
+	if m.eventPatterns == nil {
+		m.eventPatterns = new(eventTrie)
+	}
+	m.eventPatterns.insert(tokens, handler)
+	return nil
+}
+
+// eventHandler finds the handler for an event name
+func (m *MessageHandler) eventHandler(name string) EventHandler {
+	if handler, found := m.EventHandlers[name]; found {
+		return handler
+	}
+	if m.eventPatterns == nil {
+		return nil
+	}
+	return m.eventPatterns.match(strings.Split(name, "."))
+}
@@ -0,0 +1,50 @@
+package comms
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventPatterns(t *testing.T) {
+	var matched string
+	register := func(m *MessageHandler, pattern string) {
+		assert.NoError(t, m.HandleEvent(pattern, func(*SkataEvent) error {
+			matched = pattern
+			return nil
+		}))
+	}
+	handler := new(MessageHandler)
+	handler.EventHandlers = map[string]EventHandler{"job.backup.failed": func(*SkataEvent) error {
+		matched = "exact"
+		return nil
+	}}
+	register(handler, "job.>")
+	register(handler, "job.*.failed")
+	register(handler, "job.restore.*")
+	register(handler, "*.restore.failed")
+
+	cases := map[string]string{
+		"job.backup.failed":  "exact",
+		"job.cleanup.failed": "job.*.failed",
+		// the literal "job" beats "*", then "restore" beats "*"
+		"job.restore.failed":  "job.restore.*",
+		"host.restore.failed": "*.restore.failed",
+		"job.backup.started":  "job.>",
+		"job.backup":          "job.>",
+		"job":                 "",
+		"node.restore":        "",
+	}
+	for name, expected := range cases {
+		matched = ""
+		assert.NoError(t, handler.handleMessage(&SkataEvent{EventName: name}))
+		assert.Equal(t, expected, matched, name)
+	}
+}
+
+func TestInvalidEventPatterns(t *testing.T) {
+	handler := new(MessageHandler)
+	for _, pattern := range []string{"", "job..failed", "job.>.failed", "job.fail*", ">x"} {
+		assert.Equal(t, ErrInvalidPattern, handler.HandleEvent(pattern, nil), pattern)
+	}
+}
@@ -0,0 +1,79 @@
+package comms
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"skata/common"
+)
+
+// ErrNoServerName is returned when dialing over TLS to an address
+// without a host, such as a Unix socket path, and the TLS config
+// doesn't name the server to verify
+var ErrNoServerName = errors.New("comms: TLS needs a ServerName for this address")
+
+// AuthorizeNodeType is the default peer authorization. It allows a
+// peer to claim a node ID only if the node type's name, such as
+// "WorkerNode", is one of the organizational units of its certificate.
+func AuthorizeNodeType(cert *x509.Certificate, id common.SkataNodeID) error {
+	nodeType := id.GetNodeType()
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		if unit == nodeType.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate for %q may not act as a %s", cert.Subject.CommonName, nodeType)
+}
+
+// clientTLSConfig fills in the ServerName from the host of addr
+// when the config leaves it empty
+func clientTLSConfig(config *tls.Config, addr string) (*tls.Config, error) {
+	if config.ServerName != "" || config.InsecureSkipVerify {
+		return config, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return nil, ErrNoServerName
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config, nil
+}
+
+// TLSConnectionState returns the TLS state of the connection
+// and whether the connection uses TLS at all
+func (c *Connection) TLSConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// authorizePeer binds the node ID claimed in the handshake to the
+// verified certificate of the peer. Peers that did not present a
+// certificate, and plain TCP peers, are not checked. A certificate
+// that was presented but not verified, as tls.RequireAnyClientCert
+// allows, authorizes nothing.
+func (c *Connection) authorizePeer(id common.SkataNodeID) error {
+	state, ok := c.TLSConnectionState()
+	if !ok || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return &SkataError{
+			Code:    ErrCodeUnauthorized,
+			Message: fmt.Sprintf("certificate for %q is not verified", state.PeerCertificates[0].Subject.CommonName),
+		}
+	}
+	authorize := c.config.AuthorizePeer
+	if authorize == nil {
+		authorize = AuthorizeNodeType
+	}
+	if err := authorize(state.VerifiedChains[0][0], id); err != nil {
+		return &SkataError{Code: ErrCodeUnauthorized, Message: err.Error()}
+	}
+	return nil
+}
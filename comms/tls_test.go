@@ -0,0 +1,130 @@
+package comms
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"skata/common"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testPKI struct {
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	pki := new(testPKI)
+	pki.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "skata test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &pki.caKey.PublicKey, pki.caKey)
+	assert.NoError(t, err)
+	pki.ca, _ = x509.ParseCertificate(der)
+	pki.pool = x509.NewCertPool()
+	pki.pool.AddCert(pki.ca)
+	pki.serial = 1
+	return pki
+}
+
+func (pki *testPKI) issue(t *testing.T, name string, units ...string) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pki.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(pki.serial),
+		Subject:      pkix.Name{CommonName: name, OrganizationalUnit: units},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, pki.ca, &key.PublicKey, pki.caKey)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	listener, err := NewListener("127.0.0.1:0", &ConnectionConfig{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{pki.issue(t, "hub", common.HubNode.String())},
+			ClientCAs:    pki.pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	})
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	dialer := &Dialer{Config: &ConnectionConfig{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{pki.issue(t, "worker-1", common.WorkerNode.String())},
+			RootCAs:      pki.pool,
+		},
+	}}
+	source := common.GenerateID(common.WorkerNode)
+	client, err := dialer.DialContext(context.Background(), listener.Addr().String(), source)
+	assert.NoError(t, err)
+	defer client.Close()
+	server := <-listener.ConnectionChan
+	defer server.Close()
+	assert.Equal(t, source, server.Source)
+	state, ok := server.TLSConnectionState()
+	assert.True(t, ok)
+	assert.Equal(t, "worker-1", state.PeerCertificates[0].Subject.CommonName)
+
+	// the worker certificate doesn't allow impersonating a scheduler
+	_, err = dialer.DialContext(context.Background(), listener.Addr().String(), common.GenerateID(common.SchedulerNode))
+	if assert.IsType(t, new(SkataError), err) {
+		assert.Equal(t, ErrCodeUnauthorized, err.(*SkataError).Code)
+	}
+
+	// and nobody gets in without a certificate
+	dialer.Config.TLSConfig = &tls.Config{RootCAs: pki.pool}
+	_, err = dialer.DialContext(context.Background(), listener.Addr().String(), source)
+	assert.Error(t, err)
+}
+
+func TestUnverifiedClientCert(t *testing.T) {
+	pki := newTestPKI(t)
+	listener, err := NewListener("127.0.0.1:0", &ConnectionConfig{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{pki.issue(t, "hub", common.HubNode.String())},
+			ClientAuth:   tls.RequireAnyClientCert,
+		},
+	})
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	// anyone can issue themselves a worker certificate
+	rogue := newTestPKI(t)
+	dialer := &Dialer{Config: &ConnectionConfig{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{rogue.issue(t, "worker-1", common.WorkerNode.String())},
+			RootCAs:      pki.pool,
+		},
+	}}
+	_, err = dialer.DialContext(context.Background(), listener.Addr().String(), common.GenerateID(common.WorkerNode))
+	if assert.IsType(t, new(SkataError), err) {
+		assert.Equal(t, ErrCodeUnauthorized, err.(*SkataError).Code)
+	}
+}
@@ -0,0 +1,144 @@
+package comms
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Transport opens the raw connections that skata frames are
+// carried over. The framing, handshake and TLS are layered on
+// top of whatever the transport hands out.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// TCPTransport is the default transport
+type TCPTransport struct{}
+
+// Listen satisfies the Transport interface
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// Dial satisfies the Transport interface
+func (TCPTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// UnixTransport carries frames over Unix domain sockets, which
+// suits processes running on the same machine. Addresses are
+// socket paths.
+type UnixTransport struct{}
+
+// Listen satisfies the Transport interface
+func (UnixTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("unix", addr)
+}
+
+// Dial satisfies the Transport interface
+func (UnixTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", addr)
+}
+
+// Memory transport errors
+var (
+	ErrAddressInUse   = errors.New("comms: memory address already in use")
+	ErrNoListener     = errors.New("comms: no memory listener at address")
+	ErrListenerClosed = errors.New("comms: listener closed")
+)
+
+// MemoryTransport connects listeners and dialers within the same
+// process through in-memory pipes. Addresses are arbitrary names
+// scoped to the transport.
+type MemoryTransport struct {
+	lock      sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+// NewMemoryTransport creates an empty MemoryTransport
+func NewMemoryTransport() *MemoryTransport {
+	transport := new(MemoryTransport)
+	transport.listeners = make(map[string]*memoryListener)
+	return transport
+}
+
+// Listen satisfies the Transport interface
+func (m *MemoryTransport) Listen(addr string) (net.Listener, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, found := m.listeners[addr]; found {
+		return nil, ErrAddressInUse
+	}
+	listener := new(memoryListener)
+	listener.transport = m
+	listener.addr = memoryAddr(addr)
+	listener.conns = make(chan net.Conn)
+	listener.done = make(chan struct{})
+	m.listeners[addr] = listener
+	return listener, nil
+}
+
+// Dial satisfies the Transport interface
+func (m *MemoryTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	m.lock.Lock()
+	listener, found := m.listeners[addr]
+	m.lock.Unlock()
+	if !found {
+		return nil, ErrNoListener
+	}
+	client, server := net.Pipe()
+	select {
+	case listener.conns <- server:
+		return client, nil
+	case <-listener.done:
+		return nil, ErrNoListener
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.transport.lock.Lock()
+		delete(l.transport.listeners, string(l.addr))
+		l.transport.lock.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
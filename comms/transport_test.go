@@ -0,0 +1,79 @@
+package comms
+
+import (
+	"context"
+	"crypto/tls"
+	"path/filepath"
+	"skata/common"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTransport(t *testing.T, transport Transport, addr string) {
+	config := *DefaultConnectionConfig
+	config.Transport = transport
+	listener, err := NewListener(addr, &config)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	dialer := &Dialer{Config: &config}
+	source := common.GenerateID(common.SchedulerNode)
+	client, err := dialer.DialContext(context.Background(), listener.Addr().String(), source)
+	assert.NoError(t, err)
+	defer client.Close()
+	server := <-listener.ConnectionChan
+	defer server.Close()
+	assert.Equal(t, source, server.Source)
+
+	go func() {
+		request := (<-server.Pipe).(*SkataRequest)
+		server.Write(&SkataResponse{RequestID: request.ID, Data: []byte("ok")})
+	}()
+	response, err := client.Call(context.Background(), &SkataRequest{Request: Status})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ok"), response.Data)
+}
+
+func TestMemoryTransport(t *testing.T) {
+	transport := NewMemoryTransport()
+	testTransport(t, transport, "hub")
+
+	_, err := transport.Dial(context.Background(), "hub")
+	assert.Equal(t, ErrNoListener, err)
+	listener, err := transport.Listen("hub")
+	assert.NoError(t, err)
+	_, err = transport.Listen("hub")
+	assert.Equal(t, ErrAddressInUse, err)
+	listener.Close()
+}
+
+func TestUnixTransport(t *testing.T) {
+	testTransport(t, UnixTransport{}, filepath.Join(t.TempDir(), "skata.sock"))
+}
+
+func TestUnixTransportTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	config := *DefaultConnectionConfig
+	config.Transport = UnixTransport{}
+	config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{pki.issue(t, "hub")}}
+	listener, err := NewListener(filepath.Join(t.TempDir(), "skata.sock"), &config)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	// a socket path names no host to verify the certificate against
+	clientConfig := config
+	clientConfig.TLSConfig = &tls.Config{RootCAs: pki.pool}
+	dialer := &Dialer{Config: &clientConfig}
+	source := common.GenerateID(common.SchedulerNode)
+	_, err = dialer.DialContext(context.Background(), listener.Addr().String(), source)
+	assert.Equal(t, ErrNoServerName, err)
+
+	dialer.Config.TLSConfig.ServerName = "hub"
+	client, err := dialer.DialContext(context.Background(), listener.Addr().String(), source)
+	assert.NoError(t, err)
+	defer client.Close()
+	server := <-listener.ConnectionChan
+	defer server.Close()
+	assert.Equal(t, source, server.Source)
+}
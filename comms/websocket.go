@@ -0,0 +1,176 @@
+package comms
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultWebSocketPath is the HTTP path used when a
+// WebSocketTransport doesn't set one
+const DefaultWebSocketPath = "/skata"
+
+// ErrNotBinaryMessage is returned when a WebSocket peer sends
+// anything other than binary messages
+var ErrNotBinaryMessage = errors.New("comms: websocket peer sent a non-binary message")
+
+// WebSocketTransport carries frames in binary WebSocket messages,
+// one frame per message, so that nodes behind HTTP-only proxies and
+// browsers can talk to a hub. Addresses are host:port pairs.
+type WebSocketTransport struct {
+	// Path is the HTTP path the listener serves and dialers request
+	Path string
+	// CheckOrigin decides which browser origins may connect.
+	// If nil only same-origin requests are accepted.
+	CheckOrigin func(r *http.Request) bool
+	// TLSConfig switches the transport to wss. Listeners need
+	// certificates, dialers need the roots to trust.
+	TLSConfig *tls.Config
+}
+
+func (w *WebSocketTransport) path() string {
+	if w.Path == "" {
+		return DefaultWebSocketPath
+	}
+	return w.Path
+}
+
+// Listen satisfies the Transport interface
+func (w *WebSocketTransport) Listen(addr string) (net.Listener, error) {
+	baseListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if w.TLSConfig != nil {
+		baseListener = tls.NewListener(baseListener, w.TLSConfig)
+	}
+	listener := new(webSocketListener)
+	listener.addr = baseListener.Addr()
+	listener.conns = make(chan net.Conn)
+	listener.done = make(chan struct{})
+	listener.upgrader.CheckOrigin = w.CheckOrigin
+	mux := http.NewServeMux()
+	mux.Handle(w.path(), listener)
+	listener.server = &http.Server{Handler: mux}
+	go listener.server.Serve(baseListener)
+	return listener, nil
+}
+
+// Dial satisfies the Transport interface
+func (w *WebSocketTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	scheme := "ws://"
+	if w.TLSConfig != nil {
+		scheme = "wss://"
+	}
+	dialer := &websocket.Dialer{TLSClientConfig: w.TLSConfig, HandshakeTimeout: HandshakeTimeout}
+	wsConn, response, err := dialer.DialContext(ctx, scheme+addr+w.path(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	return newWebSocketConn(wsConn), nil
+}
+
+type webSocketListener struct {
+	addr      net.Addr
+	server    *http.Server
+	upgrader  websocket.Upgrader
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ServeHTTP upgrades the request and hands the connection to Accept
+func (l *webSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wsConn, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	select {
+	case l.conns <- newWebSocketConn(wsConn):
+	case <-l.done:
+		wsConn.Close()
+	}
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *webSocketListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *webSocketListener) Addr() net.Addr {
+	return l.addr
+}
+
+// webSocketConn adapts a WebSocket connection to net.Conn. Every
+// Write is sent as a single binary message and reads continue
+// seamlessly across message boundaries.
+type webSocketConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func newWebSocketConn(wsConn *websocket.Conn) *webSocketConn {
+	return &webSocketConn{Conn: wsConn}
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				return 0, ErrNotBinaryMessage
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,9 @@
+package comms
+
+import (
+	"testing"
+)
+
+func TestWebSocketTransport(t *testing.T) {
+	testTransport(t, new(WebSocketTransport), "127.0.0.1:0")
+}
@@ -0,0 +1,146 @@
+package comms
+
+import (
+	"encoding/binary"
+)
+
+// decodeError is the type of the errors reported by decoders. They
+// all match ErrMalformedMessage so callers may check for either.
+type decodeError string
+
+func (e decodeError) Error() string {
+	return string(e)
+}
+
+// Is lets errors.Is match decode errors against ErrMalformedMessage
+func (e decodeError) Is(target error) bool {
+	return target == ErrMalformedMessage
+}
+
+// Decode errors
+var (
+	// ErrShortBuffer is returned when the data ends inside a field
+	ErrShortBuffer error = decodeError("comms: message truncated")
+	// ErrBadLength is returned when a length field doesn't match
+	// the data, or a message carries unexpected trailing bytes
+	ErrBadLength error = decodeError("comms: message length mismatch")
+)
+
+// wireReader consumes a byte slice front to back, remembering
+// the first decoding failure so callers only check once at the end
+type wireReader struct {
+	data []byte
+	err  error
+}
+
+func (r *wireReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.data = nil
+}
+
+func (r *wireReader) byte() byte {
+	if len(r.data) < 1 {
+		r.fail(ErrShortBuffer)
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *wireReader) bytes(n uint64) []byte {
+	if n > uint64(len(r.data)) {
+		r.fail(ErrShortBuffer)
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *wireReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *wireReader) uint64() uint64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *wireReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.failVarint(n)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *wireReader) varint() int64 {
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.failVarint(n)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// failVarint reports a varint that ran out of data, n == 0, or
+// overflowed 64 bits, n < 0
+func (r *wireReader) failVarint(n int) {
+	if n == 0 {
+		r.fail(ErrShortBuffer)
+		return
+	}
+	r.fail(ErrBadLength)
+}
+
+// limited reads length bytes, failing with ErrBadLength if the
+// length runs past the end of the data
+func (r *wireReader) limited(length uint64) []byte {
+	if r.err == nil && length > uint64(len(r.data)) {
+		r.fail(ErrBadLength)
+	}
+	return r.bytes(length)
+}
+
+// lengthPrefixed reads a uvarint length followed by that many bytes
+func (r *wireReader) lengthPrefixed() []byte {
+	return r.limited(r.uvarint())
+}
+
+// prefixed64 reads a uint64 length followed by that many bytes
+func (r *wireReader) prefixed64() []byte {
+	return r.limited(r.uint64())
+}
+
+// rest consumes whatever is left
+func (r *wireReader) rest() []byte {
+	b := r.data
+	r.data = nil
+	return b
+}
+
+// end returns the first failure, or ErrBadLength if data is left over
+func (r *wireReader) end() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.err = ErrBadLength
+	}
+	return r.err
+}
+
+func appendLengthPrefixed(data, value []byte) []byte {
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
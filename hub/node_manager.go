@@ -1,27 +1,71 @@
 package hub
 
-import "skata/comms"
+import (
+	"skata/comms"
+	"sync"
+)
 
 // NodeManager manages the nodes that are connected to the hub
 type NodeManager struct {
-	Nodes    []*SkataNode
 	Listener *comms.Listener
+	lock     sync.Mutex
+	nodes    []*SkataNode
 }
 
 // NewNodeManager creates a NodeManager and returns it
-func NewNodeManager(listenAddr string) *NodeManager {
+func NewNodeManager(listenAddr string) (*NodeManager, error) {
+	listener, err := comms.NewListener(listenAddr, nil)
+	if err != nil {
+		return nil, err
+	}
 	manager := new(NodeManager)
-	manager.Listener = comms.NewListener(listenAddr)
-	manager.Nodes = []*SkataNode{}
-	go manager.waitForConnections()
-	return manager
+	manager.Listener = listener
+	manager.nodes = []*SkataNode{}
+	go manager.waitForConnections(listener)
+	return manager, nil
+}
+
+// AddListener accepts nodes from an additional listener, for
+// example one using the WebSocket transport, next to the main one
+func (n *NodeManager) AddListener(listener *comms.Listener) {
+	go n.waitForConnections(listener)
+}
+
+// GetNodes returns a snapshot of the connected nodes
+func (n *NodeManager) GetNodes() []*SkataNode {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]*SkataNode(nil), n.nodes...)
 }
 
-func (n *NodeManager) waitForConnections() {
-	go n.Listener.ListenAndAccept()
+// waitForConnections adds the nodes accepted by listener until
+// it is closed
+func (n *NodeManager) waitForConnections(listener *comms.Listener) {
 	for {
-		connection := <-n.Listener.ConnectionChan
+		var connection *comms.Connection
+		select {
+		case connection = <-listener.ConnectionChan:
+		case <-listener.Done():
+			return
+		}
 		node := NewSkataNode(connection)
-		n.Nodes = append(n.Nodes, node)
+		n.lock.Lock()
+		n.nodes = append(n.nodes, node)
+		n.lock.Unlock()
+		go n.removeWhenDone(node)
+	}
+}
+
+// removeWhenDone drops the node once its connection has ended,
+// for example because it stopped answering keepalive pings
+func (n *NodeManager) removeWhenDone(node *SkataNode) {
+	<-node.Pipe.Done()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for i, candidate := range n.nodes {
+		if candidate == node {
+			n.nodes = append(n.nodes[:i], n.nodes[i+1:]...)
+			return
+		}
 	}
 }
@@ -0,0 +1,52 @@
+package hub
+
+import (
+	"context"
+	"skata/common"
+	"skata/comms"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketNodes(t *testing.T) {
+	manager, err := NewNodeManager("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer manager.Listener.Close()
+
+	config := *comms.DefaultConnectionConfig
+	config.Transport = new(comms.WebSocketTransport)
+	wsListener, err := comms.NewListener("127.0.0.1:0", &config)
+	assert.NoError(t, err)
+	defer wsListener.Close()
+	manager.AddListener(wsListener)
+
+	dialer := &comms.Dialer{Config: &config}
+	source := common.GenerateID(common.WorkerNode)
+	conn, err := dialer.DialContext(context.Background(), wsListener.Addr().String(), source)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.Eventually(t, func() bool {
+		nodes := manager.GetNodes()
+		return len(nodes) == 1 && nodes[0].ID == source && nodes[0].Type == common.WorkerNode
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestDeadNodesAreRemoved(t *testing.T) {
+	manager, err := NewNodeManager("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer manager.Listener.Close()
+
+	conn, err := comms.DialContext(context.Background(), manager.Listener.Addr().String(), common.GenerateID(common.WorkerNode))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(manager.GetNodes()) == 1
+	}, time.Second, time.Millisecond*10)
+
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return len(manager.GetNodes()) == 0
+	}, time.Second, time.Millisecond*10)
+}